@@ -0,0 +1,31 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"time"
+)
+
+/*
+访问记录保存的是过期时间的UnixNano,如果直接使用系统时间,系统时间被NTP等调整时,
+时间往后跳会使大量访问记录提前过期,往前跳则会使访问记录迟迟不过期,用户的访问次数长时间无法恢复。
+所以运行期间的时间以程序启动时的系统时间为起点,之后只按单调时钟计时,不受系统时间调整的影响
+*/
+var (
+	clockBase         = time.Now()
+	clockBaseUnixNano = clockBase.UnixNano()
+)
+
+//当前时间的UnixNano,启动后不随系统时间调整而跳变
+func nowUnixNano() int64 {
+	return clockBaseUnixNano + int64(time.Since(clockBase))
+}
+
+//当前时间,与nowUnixNano一致
+func clockNow() time.Time {
+	return time.Unix(0, nowUnixNano())
+}
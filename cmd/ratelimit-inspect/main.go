@@ -0,0 +1,253 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+/*
+ratelimit-inspect 用于查看,校验及修复.ratelimit备份文件,例:
+ratelimit-inspect userVisitRule_paidMember.ratelimit
+ratelimit-inspect -windows 1s,1m,1h,24h userVisitRule_paidMember.ratelimit
+ratelimit-inspect -key 17277777770 userVisitRule_paidMember.ratelimit
+ratelimit-inspect -keys userVisitRule_paidMember.ratelimit
+ratelimit-inspect -repair fixed.ratelimit userVisitRule_paidMember.ratelimit
+ratelimit-inspect -encryption-key 2020-06=/etc/app/backup.key userVisitRule_paidMember.ratelimit
+存在问题时退出码为1
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yudeguang/ratelimit"
+)
+
+var (
+	windowsFlag  = flag.String("windows", "", "comma separated windows of the rules in ascending order, e.g. 1s,1m,1h,24h; legacy backups don't record them and records are only bound-checked when given")
+	nowFlag      = flag.String("now", "", "RFC3339 time used to check the upper bound of records, defaults to the current time")
+	keyFlag      = flag.String("key", "", "list the records of this key")
+	keyTypeFlag  = flag.String("keytype", "string", "type of -key, e.g. string, int64, uint64, netip.Addr")
+	keysFlag     = flag.Bool("keys", false, "list all keys and their record counts")
+	repairFlag   = flag.String("repair", "", "write a repaired backup without the corrupt sections to this file")
+	formatFlag   = flag.String("format", "", "format of the repaired backup: legacy or compact, defaults to the format of the input")
+	compressFlag = flag.String("compression", "", "compression of the repaired backup: none or gzip, defaults to the compression of the input")
+	encryptFlag  = flag.String("encrypt", "", "id of the key to encrypt the repaired backup with, defaults to the key of the input; use -encrypt=none to write it unencrypted")
+)
+
+//可多次指定,格式为 密钥标识=密钥文件,密钥文件中为原始的16,24或32字节AES密钥
+type encryptionKeysFlag struct{}
+
+func (encryptionKeysFlag) String() string {
+	return ""
+}
+
+func (encryptionKeysFlag) Set(s string) (err error) {
+	id, file, ok := strings.Cut(s, "=")
+	if !ok || id == "" {
+		return fmt.Errorf("%q should be id=file", s)
+	}
+	key, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	//密钥长度不对或者重复指定时RegisterEncryptionKey会panic,转换为参数错误
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+	ratelimit.RegisterEncryptionKey(id, key)
+	return nil
+}
+
+func init() {
+	flag.Var(encryptionKeysFlag{}, "encryption-key", "id=file of a key to decrypt encrypted backups with, the file holds the raw 16, 24 or 32 byte AES key; may be repeated")
+}
+
+var formatNames = []string{"legacy", "compact"}
+var compressionNames = []string{"none", "gzip"}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ratelimit-inspect [flags] file.ratelimit")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	bi, err := inspect(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	printSummary(bi)
+	if *keysFlag {
+		printKeys(bi)
+	}
+	if *keyFlag != "" {
+		if err = printKey(bi, *keyTypeFlag, *keyFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	if *repairFlag != "" {
+		if err = repair(bi, *repairFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		fmt.Println("repaired backup written to", *repairFlag)
+	}
+	if len(bi.Problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+func inspect(fileName string) (*ratelimit.BackupInspection, error) {
+	var windows []time.Duration
+	if *windowsFlag != "" {
+		for _, s := range strings.Split(*windowsFlag, ",") {
+			window, err := time.ParseDuration(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("invalid -windows: %v", err)
+			}
+			windows = append(windows, window)
+		}
+		sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+	}
+	now := time.Now()
+	if *nowFlag != "" {
+		var err error
+		if now, err = time.Parse(time.RFC3339, *nowFlag); err != nil {
+			return nil, fmt.Errorf("invalid -now: %v", err)
+		}
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ratelimit.InspectBackup(f, now, windows...)
+}
+
+func printSummary(bi *ratelimit.BackupInspection) {
+	fmt.Printf("format: %s, compression: %s", name(formatNames, bi.Format), name(compressionNames, bi.Compression))
+	if bi.KeyID != "" {
+		fmt.Printf(", encrypted with key %q", bi.KeyID)
+	}
+	fmt.Println()
+	if !bi.SavedAt.IsZero() {
+		fmt.Println("saved at:", bi.SavedAt.Format(time.RFC3339Nano))
+	}
+	fmt.Println("rules:", len(bi.Rules))
+	for _, rule := range bi.Rules {
+		fmt.Printf("  rule %d: window %v, limit %d, %d keys, %d records", rule.Index, rule.Window, rule.Limit, rule.Keys, rule.Records)
+		if rule.Records > 0 {
+			fmt.Printf(", expiring from %s to %s", rule.Oldest.Format(time.RFC3339), rule.Newest.Format(time.RFC3339))
+		}
+		fmt.Println()
+	}
+	if len(bi.Problems) == 0 {
+		fmt.Println("no problems found")
+		return
+	}
+	fmt.Println("problems:", len(bi.Problems))
+	for _, p := range bi.Problems {
+		fmt.Printf("  offset %d", p.Offset)
+		if p.Rule >= 0 {
+			fmt.Printf(", rule %d", p.Rule)
+		}
+		if p.Key != nil {
+			keyType, key, _ := ratelimit.FormatKey(p.Key)
+			fmt.Printf(", key %s(%s)", keyType, key)
+		}
+		fmt.Println(":", p.Message)
+	}
+}
+
+func printKeys(bi *ratelimit.BackupInspection) {
+	bi.Range(func(rule int, key interface{}, records []time.Time) bool {
+		keyType, text, _ := ratelimit.FormatKey(key)
+		fmt.Printf("rule %d\t%s\t%s\t%d\n", rule, keyType, text, len(records))
+		return true
+	})
+}
+
+func printKey(bi *ratelimit.BackupInspection, keyType, text string) error {
+	want, err := ratelimit.ParseKey(keyType, text)
+	if err != nil {
+		return err
+	}
+	found := false
+	bi.Range(func(rule int, key interface{}, records []time.Time) bool {
+		if key != want {
+			return true
+		}
+		found = true
+		window := bi.Rules[rule].Window
+		fmt.Printf("rule %d (window %v): %d records\n", rule, window, len(records))
+		for _, record := range records {
+			if window > 0 {
+				fmt.Printf("  visited %s, expires %s\n", record.Add(-window).Format(time.RFC3339Nano), record.Format(time.RFC3339Nano))
+			} else {
+				fmt.Printf("  expires %s\n", record.Format(time.RFC3339Nano))
+			}
+		}
+		return true
+	})
+	if !found {
+		fmt.Printf("key %s(%s) not found\n", keyType, text)
+	}
+	return nil
+}
+
+func repair(bi *ratelimit.BackupInspection, fileName string) error {
+	opts := ratelimit.SaveOptions{Format: bi.Format, Compression: bi.Compression, EncryptionKeyID: bi.KeyID}
+	if *encryptFlag == "none" {
+		opts.EncryptionKeyID = ""
+	} else if *encryptFlag != "" {
+		opts.EncryptionKeyID = *encryptFlag
+	}
+	var err error
+	if *formatFlag != "" {
+		if opts.Format, err = index(formatNames, *formatFlag); err != nil {
+			return fmt.Errorf("invalid -format: %v", err)
+		}
+	}
+	if *compressFlag != "" {
+		if opts.Compression, err = index(compressionNames, *compressFlag); err != nil {
+			return fmt.Errorf("invalid -compression: %v", err)
+		}
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	if err = bi.WriteRepaired(f, opts); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func name(names []string, i int) string {
+	if i >= 0 && i < len(names) {
+		return names[i]
+	}
+	return fmt.Sprint(i)
+}
+
+func index(names []string, s string) (int, error) {
+	for i, n := range names {
+		if n == s {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%q is not one of %s", s, strings.Join(names, ", "))
+}
@@ -0,0 +1,229 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/*
+加密后的备份数据格式,加密在压缩之后进行:
+"RLENC\x01" 密钥标识长度(1字节) 密钥标识 随机数(12字节)
+	密文块...
+每个密文块由64KB明文经AES-GCM加密而成,最后一块可以小于64KB(包括0字节),
+每块的随机数为文件头中的随机数与块序号异或,附加数据为文件头加上是否为最后一块的标志,
+因此密文块被调换顺序,删除或者截断都会导致解密失败
+*/
+
+var encryptionMagic = []byte("RLENC\x01")
+
+const encryptionChunkSize = 64 * 1024
+
+var (
+	errBackupDecrypt   = errors.New("can't decrypt the backup data,it is corrupted or encrypted with a different key")
+	errBackupTruncated = errors.New("the encrypted backup data is truncated")
+)
+
+var encryptionKeys = struct {
+	sync.RWMutex
+	byID map[string]cipher.AEAD
+}{
+	byID: make(map[string]cipher.AEAD),
+}
+
+/*
+注册用于加密备份数据的密钥,注册后在SaveOptions中设置EncryptionKeyID即可加密备份数据,例:
+ratelimit.RegisterEncryptionKey("2020-06", key)
+r.SetSaveOptions(ratelimit.SaveOptions{EncryptionKeyID: "2020-06"})
+其中:
+id  表示密钥的标识,会以明文记录在备份文件中,加载时据此选择密钥,长度为1至255字节
+key 表示AES密钥,长度为16,24或32字节,分别对应AES-128,AES-192,AES-256
+更换密钥时,同时注册新旧两个密钥,并把EncryptionKeyID设置为新密钥,之前用旧密钥加密的备份文件仍可正常加载,
+下次存盘时即改用新密钥加密
+*/
+func RegisterEncryptionKey(id string, key []byte) {
+	if len(id) == 0 || len(id) > 255 {
+		panic("encryption key id should be 1 to 255 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	encryptionKeys.Lock()
+	defer encryptionKeys.Unlock()
+	if _, exist := encryptionKeys.byID[id]; exist {
+		panic(`encryption key "` + id + `" is already registered`)
+	}
+	encryptionKeys.byID[id] = aead
+}
+
+func encryptionKey(id string) (cipher.AEAD, error) {
+	encryptionKeys.RLock()
+	defer encryptionKeys.RUnlock()
+	aead, exist := encryptionKeys.byID[id]
+	if !exist {
+		return nil, fmt.Errorf(`encryption key "%s" is not registered,please register it by RegisterEncryptionKey`, id)
+	}
+	return aead, nil
+}
+
+//分块加密写入的数据,Close时写入最后一块
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	seq    uint64
+	buf    []byte
+	out    []byte
+}
+
+func newEncryptWriter(w io.Writer, keyID string) (*encryptWriter, error) {
+	aead, err := encryptionKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	e := &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, encryptionChunkSize)}
+	e.nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(e.nonce); err != nil {
+		return nil, err
+	}
+	e.header = append(append([]byte(nil), encryptionMagic...), byte(len(keyID)))
+	e.header = append(append(e.header, keyID...), e.nonce...)
+	_, err = w.Write(e.header)
+	return e, err
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(e.buf) == encryptionChunkSize {
+			if err := e.seal(false); err != nil {
+				return 0, err
+			}
+		}
+		copied := copy(e.buf[len(e.buf):encryptionChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+copied]
+		p = p[copied:]
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) seal(final bool) error {
+	e.out = e.aead.Seal(e.out[:0], chunkNonce(e.nonce, e.seq), e.buf, chunkAdditionalData(e.header, final))
+	e.buf = e.buf[:0]
+	e.seq++
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+//读取并解密密文块,每块解密并校验通过后才返回其中的数据
+type decryptReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte
+	seq    uint64
+	chunk  []byte
+	plain  []byte
+	final  bool
+}
+
+//读取文件头,返回密钥标识及解密后的数据
+func newDecryptReader(r *bufio.Reader) (string, *decryptReader, error) {
+	header := make([]byte, len(encryptionMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, errBackupTruncated
+	}
+	id := make([]byte, header[len(encryptionMagic)])
+	if _, err := io.ReadFull(r, id); err != nil {
+		return "", nil, errBackupTruncated
+	}
+	aead, err := encryptionKey(string(id))
+	if err != nil {
+		return string(id), nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(r, nonce); err != nil {
+		return string(id), nil, errBackupTruncated
+	}
+	header = append(append(header, id...), nonce...)
+	d := &decryptReader{r: r, aead: aead, header: header, nonce: nonce, chunk: make([]byte, encryptionChunkSize+aead.Overhead())}
+	return string(id), d, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.final {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	switch err {
+	case nil:
+		//刚好读满一块时,之后没有数据才是最后一块
+		if _, err = d.r.Peek(1); err == io.EOF {
+			d.final = true
+		} else if err != nil {
+			return err
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		d.final = true
+	default:
+		return err
+	}
+	if n < d.aead.Overhead() {
+		return errBackupTruncated
+	}
+	d.plain, err = d.aead.Open(d.chunk[:0], chunkNonce(d.nonce, d.seq), d.chunk[:n], chunkAdditionalData(d.header, d.final))
+	if err != nil {
+		return errBackupDecrypt
+	}
+	d.seq++
+	return nil
+}
+
+//每块的随机数为文件头中的随机数与块序号异或
+func chunkNonce(nonce []byte, seq uint64) []byte {
+	n := append([]byte(nil), nonce...)
+	tail := n[len(n)-8:]
+	binary.BigEndian.PutUint64(tail, binary.BigEndian.Uint64(tail)^seq)
+	return n
+}
+
+func chunkAdditionalData(header []byte, final bool) []byte {
+	ad := append([]byte(nil), header...)
+	if final {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
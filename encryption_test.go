@@ -0,0 +1,64 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func init() {
+	RegisterEncryptionKey("test-old", bytes.Repeat([]byte{1}, 16))
+	RegisterEncryptionKey("test-new", bytes.Repeat([]byte{2}, 32))
+}
+
+func Test_encryptedSnapshot(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Minute, 10)
+	//数据量超过一个密文块
+	for i := 0; i < 10000; i++ {
+		r.AllowVisit("17277777770_" + strconv.Itoa(i))
+	}
+	for _, opts := range []SaveOptions{
+		{EncryptionKeyID: "test-old"},
+		{Format: BackupFormatCompact, Compression: CompressionGzip, EncryptionKeyID: "test-new"},
+	} {
+		r.SetSaveOptions(opts)
+		var buf bytes.Buffer
+		if err := r.SaveTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		b := buf.Bytes()
+		if bytes.Contains(b, []byte("17277777770")) {
+			t.Fatalf("%+v: backup data contains keys in clear text", opts)
+		}
+		loaded := NewRule()
+		loaded.AddRule(time.Minute, 10)
+		if err := loaded.LoadFrom(bytes.NewReader(b)); err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		if stats := loaded.LastLoadStatistics(); stats.Keys != 10000 {
+			t.Fatalf("%+v: unexpected load statistics: %+v", opts, stats)
+		}
+		//篡改或截断的备份数据均无法加载
+		tampered := append([]byte(nil), b...)
+		tampered[len(tampered)/2] ^= 1
+		for _, data := range [][]byte{tampered, b[:len(b)-1], b[:len(b)/2]} {
+			loaded = NewRule()
+			loaded.AddRule(time.Minute, 10)
+			if err := loaded.LoadFrom(bytes.NewReader(data)); err == nil {
+				t.Fatalf("%+v: expected corrupted encrypted backup to fail", opts)
+			}
+		}
+	}
+	r.SetSaveOptions(SaveOptions{EncryptionKeyID: "unregistered"})
+	if err := r.SaveTo(new(bytes.Buffer)); err == nil {
+		t.Fatal("expected saving with an unregistered key to fail")
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"container/heap"
+)
+
+/*
+每个分片用一个按到期时间排序的小根堆记录其中各用户下一次需要检查的时间,清除过期数据时只处理已到期的用户,
+而不是每次遍历所有用户,用户数很多而大部分用户不再访问时,清除的开销只与实际过期的用户数有关。
+用户加入时按当时的访问记录的过期时间入堆,之后的访问不再调整堆,到期检查时如果仍有未过期的访问记录,
+则按最新一条访问记录的过期时间重新入堆,所以一个用户在连续访问期间大约每个计时周期只需检查一次。
+队列被回收后其在堆中的记录不会立即删除,到期时根据gen判断已失效并丢弃
+*/
+
+//堆中的一条记录
+type expiryEntry struct {
+	due int64       //到期时间的UnixNano
+	key interface{} //用户
+	q   *autoGrowCircleQueueInt64
+	gen uint64 //入堆时队列的gen,队列回收后gen改变,此记录即失效
+}
+
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].due < h[j].due }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x interface{}) {
+	*h = append(*h, x.(expiryEntry))
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = expiryEntry{}
+	*h = old[:n-1]
+	return e
+}
+
+//把到期时间不晚于now的记录依次追加到due中返回,调用者需持有分片的锁
+func (h *expiryHeap) popDue(now int64, due []expiryEntry) []expiryEntry {
+	for len(*h) > 0 && (*h)[0].due <= now {
+		due = append(due, heap.Pop(h).(expiryEntry))
+	}
+	return due
+}
+
+//只保留仍在queues中的用户的记录,返回新的堆,调用者需持有分片的锁
+func (h expiryHeap) live(queues map[interface{}]*autoGrowCircleQueueInt64) expiryHeap {
+	var live expiryHeap
+	for _, e := range h {
+		if queues[e.key] == e.q {
+			live = append(live, e)
+		}
+	}
+	heap.Init(&live)
+	return live
+}
+
+//把用户加入其所在分片的堆中,调用者需持有分片的锁
+func (sh *keyIndexShard) schedule(e expiryEntry) {
+	heap.Push(&sh.expiry, e)
+}
+
+//在特定时间间隔内执行一次删除过期数据操作,只检查已到期的用户
+func (s *singleRule) deleteExpiredOnce() {
+	now := nowUnixNano()
+	var due []expiryEntry
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.locker.Lock()
+		due = sh.expiry.popDue(now, due[:0])
+		sh.locker.Unlock()
+		for _, e := range due {
+			s.expire(sh, e)
+		}
+	}
+}
+
+//检查到期的用户,所有访问记录均已过期时删除该用户,否则按最新一条访问记录的过期时间重新入堆
+func (s *singleRule) expire(sh *keyIndexShard, e expiryEntry) {
+	if !e.q.lockFor(s, e.key) {
+		return
+	}
+	if e.q.gen != e.gen {
+		e.q.locker.Unlock()
+		return
+	}
+	e.q.deleteExpired()
+	if e.q.usedSize() > 0 {
+		e.due = e.q.newest()
+		e.q.locker.Unlock()
+	} else {
+		e.q.locker.Unlock()
+		//如果该用户的所有访问记录均过期了，那么就删除该用户,并回收其队列以便下次重复使用
+		released, gone := s.releaseIfEmpty(e.key)
+		if released {
+			s.notifyKey(e.key, Observer.OnKeyExpired)
+		}
+		if gone {
+			return
+		}
+		//检查后该用户又有了新的访问
+		e.due = nowUnixNano() + int64(s.defaultExpiration)
+	}
+	sh.locker.Lock()
+	sh.schedule(e)
+	sh.locker.Unlock()
+}
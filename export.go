@@ -0,0 +1,330 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+以文本形式导出或导入各规则下所有用户的访问记录,便于用标准工具查看,比较及手工修改,例如删除某个用户的全部访问记录
+访问时间均为RFC3339Nano格式的UTC时间,与备份文件不同,导出的是用户实际访问的时间,而不是访问记录的过期时间
+key类型除string及各整数类型外,netip.Addr以IP字符串表示,[16]byte以十六进制表示,
+其它注册了KeyCodec的类型表示为"codec:类型标识",key为编码后数据的base64
+*/
+
+var csvHeader = []string{"rule", "window", "limit", "key_type", "key", "visit"}
+
+//JSON Lines格式中每一行对应某条规则下的一个用户
+type exportedKey struct {
+	Rule    int      `json:"rule"`
+	Window  string   `json:"window"`
+	Limit   int      `json:"limit"`
+	KeyType string   `json:"key_type"`
+	Key     string   `json:"key"`
+	Visits  []string `json:"visits"`
+}
+
+/*
+以JSON Lines格式导出所有规则下所有用户的访问记录,每行对应某条规则下的一个用户,例:
+{"rule":0,"window":"1h0m0s","limit":100,"key_type":"string","key":"ydg","visits":["2020-06-01T08:00:00.123456789Z"]}
+*/
+func (r *Rule) ExportJSONLines(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	enc := json.NewEncoder(buf)
+	err := r.export(func(sr *snapshotRule, k snapshotKey, keyType, key string) error {
+		line := exportedKey{Rule: sr.index, Window: sr.expiration.String(), Limit: sr.limit, KeyType: keyType, Key: key}
+		for _, record := range k.records {
+			line.Visits = append(line.Visits, formatVisit(record, sr.expiration))
+		}
+		return enc.Encode(line)
+	})
+	if err != nil {
+		return err
+	}
+	return buf.Flush()
+}
+
+/*
+以CSV格式导出所有规则下所有用户的访问记录,第一行为表头,之后每行对应一条访问记录,例:
+rule,window,limit,key_type,key,visit
+0,1h0m0s,100,string,ydg,2020-06-01T08:00:00.123456789Z
+*/
+func (r *Rule) ExportCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	err := r.export(func(sr *snapshotRule, k snapshotKey, keyType, key string) error {
+		for _, record := range k.records {
+			row := []string{strconv.Itoa(sr.index), sr.expiration.String(), strconv.Itoa(sr.limit), keyType, key, formatVisit(record, sr.expiration)}
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+//依次导出各规则下未过期的访问记录
+func (r *Rule) export(fn func(sr *snapshotRule, k snapshotKey, keyType, key string) error) error {
+	if len(r.rules) == 0 {
+		panic("rule is empty，please add rule by AddRule")
+	}
+	var stats BackupStatistics
+	for i := range r.rules {
+		sr := r.rules[i].snapshot(i, &stats)
+		for _, k := range sr.keys {
+			keyType, key, err := FormatKey(k.key)
+			if err != nil {
+				return err
+			}
+			if err = fn(sr, k, keyType, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+导入由ExportJSONLines导出(或按其格式手工编辑)的访问记录,与LoadFrom一样只能在程序初始化,还未有用户访问时调用
+导入前会先校验所有数据,规则的计时周期需与当前规则一致,同一用户的访问时间需依次变大,且不能晚于当前时间,
+出错时返回的位置为出错数据所在的行号。每行须为一个完整的JSON对象,空行会被忽略
+*/
+func (r *Rule) ImportJSONLines(rd io.Reader) error {
+	im := r.newTextImporter()
+	//访问次数很多的用户一行可能很长,不使用有长度限制的bufio.Scanner
+	br := bufio.NewReader(rd)
+	for line := int64(1); ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if len(bytes.TrimSpace(b)) > 0 {
+			var k exportedKey
+			if err := json.Unmarshal(b, &k); err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+			for _, visit := range k.Visits {
+				if err := im.add(k.Rule, k.Window, k.KeyType, k.Key, visit, line); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	_, err := r.load(im.s)
+	return err
+}
+
+/*
+导入由ExportCSV导出(或按其格式手工编辑)的访问记录,第一行须为表头,校验规则与ImportJSONLines相同
+*/
+func (r *Rule) ImportCSV(rd io.Reader) error {
+	im := r.newTextImporter()
+	cr := csv.NewReader(rd)
+	cr.FieldsPerRecord = len(csvHeader)
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	if strings.Join(header, ",") != strings.Join(csvHeader, ",") {
+		return fmt.Errorf("unexpected csv header:%q,want:%q", header, csvHeader)
+	}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := cr.FieldPos(0)
+		ruleIndex, err := strconv.Atoi(row[0])
+		if err != nil {
+			return fmt.Errorf("line %d: invalid rule %q", line, row[0])
+		}
+		if err = im.add(ruleIndex, row[1], row[3], row[4], row[5], int64(line)); err != nil {
+			return err
+		}
+	}
+	_, err = r.load(im.s)
+	return err
+}
+
+//把文本形式的访问记录整理成备份数据,以便与加载备份文件共用校验及加载流程
+type textImporter struct {
+	s     *snapshot
+	index []map[interface{}]int //各规则下每个key在snapshotRule.keys中的下标
+}
+
+func (r *Rule) newTextImporter() *textImporter {
+	if len(r.rules) == 0 {
+		panic("rule is empty，please add rule by AddRule")
+	}
+	im := &textImporter{s: new(snapshot)}
+	for i := range r.rules {
+		im.s.rules = append(im.s.rules, &snapshotRule{index: i, expiration: r.rules[i].defaultExpiration, limit: r.rules[i].numberOfAllowedAccesses})
+		im.index = append(im.index, make(map[interface{}]int))
+	}
+	return im
+}
+
+func (im *textImporter) add(ruleIndex int, window, keyType, keyText, visit string, line int64) error {
+	if ruleIndex < 0 || ruleIndex >= len(im.s.rules) {
+		return fmt.Errorf("line %d: rule %d does not exist", line, ruleIndex)
+	}
+	sr := im.s.rules[ruleIndex]
+	if expiration, err := time.ParseDuration(window); err != nil || expiration != sr.expiration {
+		return fmt.Errorf("line %d: window %q of rule %d is inconsistent with current rule %v", line, window, ruleIndex, sr.expiration)
+	}
+	key, err := ParseKey(keyType, keyText)
+	if err != nil {
+		return fmt.Errorf("line %d: %v", line, err)
+	}
+	t, err := time.Parse(time.RFC3339Nano, visit)
+	if err != nil {
+		return fmt.Errorf("line %d: %v", line, err)
+	}
+	record := t.Add(sr.expiration).UnixNano()
+	pos, exist := im.index[ruleIndex][key]
+	if !exist {
+		pos = len(sr.keys)
+		im.index[ruleIndex][key] = pos
+		sr.keys = append(sr.keys, snapshotKey{key: key, offset: line})
+	}
+	k := &sr.keys[pos]
+	//同一用户的访问时间必须依次变大
+	if n := len(k.records); n > 0 && record < k.records[n-1] {
+		return fmt.Errorf("line %d: visit %s of %v is earlier than its previous visit", line, visit, key)
+	}
+	k.records = append(k.records, record)
+	return nil
+}
+
+//访问记录保存的是过期时间,减去计时周期即为访问时间
+func formatVisit(record int64, expiration time.Duration) string {
+	return time.Unix(0, record).Add(-expiration).UTC().Format(time.RFC3339Nano)
+}
+
+/*
+把key转换为导出时使用的文本形式,返回其类型名称及文本,例:
+FormatKey(int64(42)) 返回 "int64","42"
+*/
+func FormatKey(key interface{}) (keyType, text string, err error) {
+	switch k := key.(type) {
+	case string:
+		return "string", k, nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%T", key), fmt.Sprint(key), nil
+	case netip.Addr:
+		return "netip.Addr", k.String(), nil
+	case [16]byte:
+		return "[16]byte", hex.EncodeToString(k[:]), nil
+	}
+	tag, data, err := encodeCustomKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	return "codec:" + strconv.Itoa(int(tag)), base64.StdEncoding.EncodeToString(data), nil
+}
+
+/*
+把FormatKey生成的文本形式的key转换回原始类型,例:
+ParseKey("int64", "42") 返回 int64(42)
+*/
+func ParseKey(keyType, text string) (interface{}, error) {
+	var bitSize int
+	switch keyType {
+	case "string":
+		return text, nil
+	case "netip.Addr":
+		return netip.ParseAddr(text)
+	case "[16]byte":
+		var b [16]byte
+		data, err := hex.DecodeString(text)
+		if err != nil || len(data) != len(b) {
+			return nil, fmt.Errorf("invalid [16]byte key %q", text)
+		}
+		copy(b[:], data)
+		return b, nil
+	case "int", "uint":
+		bitSize = strconv.IntSize
+	case "int8", "uint8":
+		bitSize = 8
+	case "int16", "uint16":
+		bitSize = 16
+	case "int32", "uint32":
+		bitSize = 32
+	case "int64", "uint64":
+		bitSize = 64
+	default:
+		if !strings.HasPrefix(keyType, "codec:") {
+			return nil, fmt.Errorf("unknown key type %q", keyType)
+		}
+		tag, err := strconv.ParseUint(strings.TrimPrefix(keyType, "codec:"), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("unknown key type %q", keyType)
+		}
+		data, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q of type %q", text, keyType)
+		}
+		return decodeCustomKey(uint8(tag), data)
+	}
+	if strings.HasPrefix(keyType, "u") {
+		v, err := strconv.ParseUint(text, 10, bitSize)
+		if err != nil {
+			return nil, err
+		}
+		switch keyType {
+		case "uint":
+			return uint(v), nil
+		case "uint8":
+			return uint8(v), nil
+		case "uint16":
+			return uint16(v), nil
+		case "uint32":
+			return uint32(v), nil
+		}
+		return v, nil
+	}
+	v, err := strconv.ParseInt(text, 10, bitSize)
+	if err != nil {
+		return nil, err
+	}
+	switch keyType {
+	case "int":
+		return int(v), nil
+	case "int8":
+		return int8(v), nil
+	case "int16":
+		return int16(v), nil
+	case "int32":
+		return int32(v), nil
+	}
+	return v, nil
+}
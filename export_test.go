@@ -0,0 +1,90 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_exportImport(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Hour, 100)
+	r.AddRule(time.Minute, 10)
+	keys := []interface{}{"ydg", 42, uint16(7), testTenantUser{TenantID: 1, UserID: 2}}
+	for _, key := range keys {
+		r.AllowVisit(key)
+		r.AllowVisit(key)
+	}
+	for name, c := range map[string]struct {
+		export func(io.Writer) error
+		load   func(*Rule, io.Reader) error
+	}{
+		"jsonl": {r.ExportJSONLines, (*Rule).ImportJSONLines},
+		"csv":   {r.ExportCSV, (*Rule).ImportCSV},
+	} {
+		var buf bytes.Buffer
+		if err := c.export(&buf); err != nil {
+			t.Fatalf("%s: export: %v", name, err)
+		}
+		restored := NewRule()
+		restored.AddRule(time.Hour, 100)
+		restored.AddRule(time.Minute, 10)
+		if err := c.load(restored, &buf); err != nil {
+			t.Fatalf("%s: import: %v", name, err)
+		}
+		for _, key := range keys {
+			got, want := restored.RemainingVisits(key), r.RemainingVisits(key)
+			if got[0] != want[0] || got[1] != want[1] {
+				t.Fatalf("%s: remaining visits of %v: got %v want %v", name, key, got, want)
+			}
+		}
+	}
+}
+
+func Test_importRejectsDisorder(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Hour, 100)
+	csv := "rule,window,limit,key_type,key,visit\n" +
+		"0,1h0m0s,100,string,ydg," + time.Now().UTC().Format(time.RFC3339Nano) + "\n" +
+		"0,1h0m0s,100,string,ydg," + time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano) + "\n"
+	err := r.ImportCSV(strings.NewReader(csv))
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("expected an ordering error at line 3, got %v", err)
+	}
+}
+
+//空行也计入行号
+func Test_importJSONLinesLineNumbers(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Hour, 100)
+	visit := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano)
+	jsonLines := `{"rule":0,"window":"1h0m0s","limit":100,"key_type":"string","key":"ydg","visits":["` + visit + `"]}` + "\n" +
+		"\n" +
+		"   \n" +
+		`{"rule":0,"window":"1h0m0s","limit":100,"key_type":"unknown","key":"andy","visits":["` + visit + `"]}` + "\n"
+	err := r.ImportJSONLines(strings.NewReader(jsonLines))
+	if err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Fatalf("expected an error at line 4, got %v", err)
+	}
+	//多行的JSON对象在其第一行报错
+	err = r.ImportJSONLines(strings.NewReader("\n{\n" + `"rule":0}` + "\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected an error at line 2, got %v", err)
+	}
+	//最后一行没有换行符
+	err = r.ImportJSONLines(strings.NewReader(strings.TrimSuffix(strings.Replace(jsonLines, "unknown", "string", 1), "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.RemainingVisits("ydg")[0] != 99 || r.RemainingVisits("andy")[0] != 99 {
+		t.Fatal("expected both keys to be imported")
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !windows
+
+package ratelimit
+
+import (
+	"os"
+)
+
+//当前平台不支持文件锁,只打开锁文件,不做多进程互斥
+func lockFile(fileName string) (*os.File, error) {
+	return os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0644)
+}
+
+func unlockFile(f *os.File) error {
+	return f.Close()
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows
+
+package ratelimit
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_lockFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.ratelimit.lock")
+	f, err := lockFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lockFile(fileName); err == nil {
+		t.Fatal("expected the second lock on the same backup file to fail")
+	}
+	if err = unlockFile(f); err != nil {
+		t.Fatal(err)
+	}
+	f, err = lockFile(fileName)
+	if err != nil {
+		t.Fatalf("lock after unlock: %v", err)
+	}
+	unlockFile(f)
+}
+
+func Test_loadingLockedBackupFile(t *testing.T) {
+	dir := t.TempDir()
+	r := NewRule()
+	r.AddRule(time.Minute, 10)
+	r.SetSaveOptions(SaveOptions{Directory: dir})
+	r.LoadingAndAutoSaveToDisc("locked", time.Hour)
+	defer r.Close()
+	//同一备份文件已被其它Rule使用
+	other := NewRule()
+	other.AddRule(time.Minute, 10)
+	other.SetSaveOptions(SaveOptions{Directory: dir})
+	func() {
+		defer func() {
+			err := recover()
+			if err == nil || !strings.Contains(err.(string), "locked by another process") {
+				t.Fatalf("expected panic for a locked backup file,got %v", err)
+			}
+		}()
+		other.LoadingAndAutoSaveToDisc("locked", time.Hour)
+	}()
+	//释放锁后可以使用
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	again := NewRule()
+	again.AddRule(time.Minute, 10)
+	again.SetSaveOptions(SaveOptions{Directory: dir})
+	again.LoadingAndAutoSaveToDisc("locked", time.Hour)
+	again.Close()
+}
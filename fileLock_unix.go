@@ -0,0 +1,45 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package ratelimit
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+//对锁文件加排它的建议锁(flock),进程退出时由操作系统自动释放,已被其它进程锁定时返回lockedError,其内容为持有锁的进程号
+func lockFile(fileName string) (*os.File, error) {
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		b := make([]byte, 32)
+		n, _ := f.ReadAt(b, 0)
+		f.Close()
+		return nil, lockedError(strings.TrimSpace(string(b[:n])))
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	//写入当前进程号,便于其它进程报错时指明是哪个进程持有锁
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+	return f, nil
+}
+
+//释放锁,锁文件本身保留,以免删除时与其它进程加锁冲突
+func unlockFile(f *os.File) error {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return f.Close()
+}
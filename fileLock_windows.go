@@ -0,0 +1,38 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+//go:build windows
+
+package ratelimit
+
+import (
+	"os"
+	"syscall"
+)
+
+//ERROR_SHARING_VIOLATION,文件已被其它进程打开
+const errorSharingViolation syscall.Errno = 32
+
+//以独占方式(共享模式为0)打开锁文件,其它进程打开时会失败,进程退出时由操作系统自动关闭
+func lockFile(fileName string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(fileName)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == errorSharingViolation {
+		return nil, lockedError("")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), fileName), nil
+}
+
+//释放锁,锁文件本身保留,以免删除时与其它进程加锁冲突
+func unlockFile(f *os.File) error {
+	return f.Close()
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+//备份数据中发现的问题
+type BackupProblem struct {
+	Offset  int64       //问题所在的位置,即(解压后的)备份数据中的字节偏移
+	Rule    int         //问题所在规则的下标,与规则无关时为-1
+	Key     interface{} //问题所在的key,与key无关时为nil
+	Message string
+}
+
+//备份数据中单条规则的统计信息
+type BackupRuleInfo struct {
+	Index   int
+	Window  time.Duration //计时周期,原始格式中未记录,为检查时提供的计时周期,未提供时为0
+	Limit   int           //允许访问次数,原始格式中未记录,为0
+	Keys    int           //有效的key数量
+	Records int           //有效的访问记录数量
+	Oldest  time.Time     //最早的访问记录的过期时间
+	Newest  time.Time     //最晚的访问记录的过期时间
+}
+
+//备份数据的检查结果,其中的数据已去掉损坏的部分
+type BackupInspection struct {
+	Format      int
+	Compression int
+	KeyID       string    //加密所用密钥的标识,未加密时为空
+	SavedAt     time.Time //存盘时间,仅紧凑格式有记录
+	Rules       []BackupRuleInfo
+	Problems    []BackupProblem
+	s           *snapshot
+}
+
+/*
+检查备份数据,与加载时不同,遇到问题时不会直接返回错误,而是记录问题所在的位置并尽量继续检查,例:
+f, _ := os.Open("userVisitRule_paidMember.ratelimit")
+bi, err := ratelimit.InspectBackup(f, time.Now(), time.Hour*24, time.Hour, time.Minute, time.Second)
+其中:
+now     表示检查访问记录上限时使用的时间,访问记录不能晚于now加上计时周期
+windows 表示各条规则的计时周期,需按从小到大排列,即与AddRule后的顺序相同,原始格式的备份文件中未记录计时周期,
+        未提供时不检查访问记录的上限,紧凑格式中已记录计时周期,无需提供
+同一key的访问记录顺序错乱或者超出上限时,丢弃该key;key的类型未注册KeyCodec时,以原始数据保留;
+备份数据结构损坏,无法继续解析时,丢弃之后的所有数据,缺失的规则以空规则代替
+仅在无法识别备份数据(例如gzip数据损坏,加密所用的密钥未注册)时返回错误
+*/
+func InspectBackup(rd io.Reader, now time.Time, windows ...time.Duration) (*BackupInspection, error) {
+	sr := &snapshotReader{tolerant: true, now: now.UnixNano(), windows: windows}
+	s, err := decodeSnapshot(rd, sr)
+	if s == nil {
+		return nil, err
+	}
+	if err != nil {
+		//结构损坏,之后的数据均无法解析
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		rule := len(s.rules) - 1
+		sr.problems = append(sr.problems, BackupProblem{Offset: sr.pos, Rule: rule, Message: fmt.Sprintf("%v,the remaining data is dropped", err)})
+		//补齐缺失的规则,以便修复后的备份文件规则数量保持一致,规则数量本身已损坏时不补齐
+		if s.ruleNum <= 1024 {
+			for i := len(s.rules); i < s.ruleNum; i++ {
+				s.rules = append(s.rules, &snapshotRule{index: i})
+			}
+		}
+	}
+	bi := &BackupInspection{Format: s.format, Compression: s.compression, KeyID: s.keyID, Problems: sr.problems, s: s}
+	if s.savedAt != 0 {
+		bi.SavedAt = time.Unix(0, s.savedAt)
+	}
+	for i, rule := range s.rules {
+		if rule.expiration == 0 && i < len(windows) {
+			rule.expiration = windows[i]
+		}
+		info := BackupRuleInfo{Index: rule.index, Window: rule.expiration, Limit: rule.limit, Keys: len(rule.keys)}
+		for _, k := range rule.keys {
+			if len(k.records) == 0 {
+				continue
+			}
+			oldest, newest := time.Unix(0, k.records[0]), time.Unix(0, k.records[len(k.records)-1])
+			if info.Records == 0 || oldest.Before(info.Oldest) {
+				info.Oldest = oldest
+			}
+			if info.Records == 0 || newest.After(info.Newest) {
+				info.Newest = newest
+			}
+			info.Records += len(k.records)
+		}
+		bi.Rules = append(bi.Rules, info)
+	}
+	return bi, nil
+}
+
+//依次遍历各规则下每个有效key的访问记录,访问记录为其过期时间,fn返回false时停止遍历
+func (bi *BackupInspection) Range(fn func(rule int, key interface{}, records []time.Time) bool) {
+	for i, rule := range bi.s.rules {
+		for _, k := range rule.keys {
+			records := make([]time.Time, len(k.records))
+			for ii, record := range k.records {
+				records[ii] = time.Unix(0, record)
+			}
+			if !fn(i, k.key, records) {
+				return
+			}
+		}
+	}
+}
+
+//把去掉损坏部分后的数据按指定格式写入w,生成修复后的备份文件
+func (bi *BackupInspection) WriteRepaired(w io.Writer, opts SaveOptions) error {
+	return writeSnapshot(w, opts, len(bi.s.rules), func(i int) *snapshotRule {
+		return bi.s.rules[i]
+	})
+}
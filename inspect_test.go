@@ -0,0 +1,56 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func Test_inspectBackup(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Minute, 10)
+	r.AllowVisit("a")
+	r.AllowVisit("a")
+	var buf bytes.Buffer
+	if err := r.SaveTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	//原始格式: 规则数量(8) 规则下标(8) key数量(8) key类型(1) 长度(8) "a"(1) 记录数量(8) 记录(8) 记录(8)
+	const secondRecord = 8 + 8 + 8 + 1 + 8 + 1 + 8 + 8
+	binary.LittleEndian.PutUint64(b[secondRecord:], 1)
+	bi, err := InspectBackup(bytes.NewReader(b), time.Now(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bi.Problems) != 1 || bi.Problems[0].Offset != secondRecord || bi.Problems[0].Key != "a" {
+		t.Fatalf("unexpected problems: %+v", bi.Problems)
+	}
+	if bi.Rules[0].Keys != 0 {
+		t.Fatalf("corrupt key was not dropped: %+v", bi.Rules[0])
+	}
+	//截断的备份文件,修复后规则数量不变,可以正常加载
+	bi, err = InspectBackup(bytes.NewReader(b[:secondRecord-4]), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bi.Problems) != 1 || len(bi.Rules) != 1 {
+		t.Fatalf("unexpected inspection of truncated backup: %+v %+v", bi.Problems, bi.Rules)
+	}
+	var repaired bytes.Buffer
+	if err = bi.WriteRepaired(&repaired, SaveOptions{Format: BackupFormatCompact}); err != nil {
+		t.Fatal(err)
+	}
+	restored := NewRule()
+	restored.AddRule(time.Minute, 10)
+	if err = restored.LoadFrom(&repaired); err != nil {
+		t.Fatal(err)
+	}
+}
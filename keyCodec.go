@@ -0,0 +1,180 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+	"sync"
+)
+
+/*
+自定义key类型的编解码器,用于在备份数据中保存string及整数以外的key,例如由租户ID及用户ID组成的结构体:
+type tenantUser struct {
+	TenantID uint32
+	UserID   uint32
+}
+type tenantUserCodec struct{}
+func (tenantUserCodec) Encode(key interface{}) ([]byte, error) {
+	k := key.(tenantUser)
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint32(b, k.TenantID)
+	binary.LittleEndian.PutUint32(b[4:], k.UserID)
+	return b, nil
+}
+func (tenantUserCodec) Decode(b []byte) (interface{}, error) {
+	if len(b) != 8 {
+		return nil, errors.New("invalid tenantUser key")
+	}
+	return tenantUser{binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])}, nil
+}
+ratelimit.RegisterKeyCodec(0x20, tenantUser{}, tenantUserCodec{})
+*/
+type KeyCodec interface {
+	Encode(key interface{}) ([]byte, error)
+	Decode(data []byte) (interface{}, error)
+}
+
+//类型标识0x00至0x1F为内置类型保留,自定义类型只能使用0x20至0xFF
+//其中0x00至0x0A为string及各整数类型,由各备份文件格式自行编码
+const (
+	keyTagBytes16   = 0x0B //[16]byte,例如UUID
+	keyTagNetipAddr = 0x0C //netip.Addr
+	minCustomKeyTag = 0x20
+)
+
+var errUnknownKeyType = errors.New("unknown key type")
+
+//检查备份文件时,未注册KeyCodec的key以原始数据保存,以便修复备份文件时原样写回
+type unknownKey struct {
+	tag  uint8
+	data string
+}
+
+type registeredKeyCodec struct {
+	tag   uint8
+	typ   reflect.Type
+	codec KeyCodec
+}
+
+var keyCodecs = struct {
+	sync.RWMutex
+	byType map[reflect.Type]registeredKeyCodec
+	byTag  map[uint8]registeredKeyCodec
+}{
+	byType: make(map[reflect.Type]registeredKeyCodec),
+	byTag:  make(map[uint8]registeredKeyCodec),
+}
+
+func init() {
+	registerKeyCodec(keyTagBytes16, [16]byte{}, bytes16KeyCodec{})
+	registerKeyCodec(keyTagNetipAddr, netip.Addr{}, netipAddrKeyCodec{})
+}
+
+/*
+注册自定义key类型的编解码器,注册后该类型的key才能被SaveToDiscOnce,SaveTo等保存到备份数据中,例:
+RegisterKeyCodec(0x20, tenantUser{}, tenantUserCodec{})
+其中:
+tag    表示该类型在备份数据中的类型标识,只能使用0x20至0xFF,一经使用不应再修改,否则历史备份文件将无法加载
+sample 表示该类型的一个值,仅用于确定key的类型
+[16]byte以及netip.Addr已内置支持,无需注册
+*/
+func RegisterKeyCodec(tag uint8, sample interface{}, codec KeyCodec) {
+	if tag < minCustomKeyTag {
+		panic(fmt.Sprintf("key codec tag 0x%02X is reserved,please use 0x20 to 0xFF", tag))
+	}
+	registerKeyCodec(tag, sample, codec)
+}
+
+func registerKeyCodec(tag uint8, sample interface{}, codec KeyCodec) {
+	typ := reflect.TypeOf(sample)
+	if typ == nil || codec == nil {
+		panic("key codec sample and codec can't be nil")
+	}
+	if !typ.Comparable() {
+		panic("key type " + typ.String() + " is not comparable and can't be used as a key")
+	}
+	keyCodecs.Lock()
+	defer keyCodecs.Unlock()
+	if _, exist := keyCodecs.byTag[tag]; exist {
+		panic(fmt.Sprintf("key codec tag 0x%02X is already registered", tag))
+	}
+	if _, exist := keyCodecs.byType[typ]; exist {
+		panic("key codec of type " + typ.String() + " is already registered")
+	}
+	c := registeredKeyCodec{tag: tag, typ: typ, codec: codec}
+	keyCodecs.byTag[tag] = c
+	keyCodecs.byType[typ] = c
+}
+
+//用注册的编解码器对string及整数以外的key编码
+func encodeCustomKey(key interface{}) (uint8, []byte, error) {
+	if k, ok := key.(unknownKey); ok {
+		return k.tag, []byte(k.data), nil
+	}
+	keyCodecs.RLock()
+	c, exist := keyCodecs.byType[reflect.TypeOf(key)]
+	keyCodecs.RUnlock()
+	if !exist {
+		return 0, nil, fmt.Errorf("key type %T is not supported,please register a KeyCodec for it by RegisterKeyCodec", key)
+	}
+	data, err := c.codec.Encode(key)
+	if err != nil {
+		return 0, nil, fmt.Errorf("encode key %v: %v", key, err)
+	}
+	return c.tag, data, nil
+}
+
+//用注册的编解码器对string及整数以外的key解码
+func decodeCustomKey(tag uint8, data []byte) (interface{}, error) {
+	keyCodecs.RLock()
+	c, exist := keyCodecs.byTag[tag]
+	keyCodecs.RUnlock()
+	if !exist {
+		return nil, fmt.Errorf("%w 0x%02X,please register a KeyCodec for it by RegisterKeyCodec", errUnknownKeyType, tag)
+	}
+	key, err := c.codec.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if reflect.TypeOf(key) != c.typ {
+		return nil, fmt.Errorf("KeyCodec of type %v decoded a key of type %T", c.typ, key)
+	}
+	return key, nil
+}
+
+//[16]byte类型key的编解码器
+type bytes16KeyCodec struct{}
+
+func (bytes16KeyCodec) Encode(key interface{}) ([]byte, error) {
+	b := key.([16]byte)
+	return b[:], nil
+}
+
+func (bytes16KeyCodec) Decode(data []byte) (interface{}, error) {
+	var b [16]byte
+	if len(data) != len(b) {
+		return nil, fmt.Errorf("invalid [16]byte key length:%d", len(data))
+	}
+	copy(b[:], data)
+	return b, nil
+}
+
+//netip.Addr类型key的编解码器
+type netipAddrKeyCodec struct{}
+
+func (netipAddrKeyCodec) Encode(key interface{}) ([]byte, error) {
+	return key.(netip.Addr).MarshalBinary()
+}
+
+func (netipAddrKeyCodec) Decode(data []byte) (interface{}, error) {
+	var addr netip.Addr
+	err := addr.UnmarshalBinary(data)
+	return addr, err
+}
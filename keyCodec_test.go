@@ -0,0 +1,82 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+type testTenantUser struct {
+	TenantID uint32
+	UserID   uint32
+}
+
+type testTenantUserCodec struct{}
+
+func (testTenantUserCodec) Encode(key interface{}) ([]byte, error) {
+	k := key.(testTenantUser)
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint32(b, k.TenantID)
+	binary.LittleEndian.PutUint32(b[4:], k.UserID)
+	return b, nil
+}
+
+func (testTenantUserCodec) Decode(b []byte) (interface{}, error) {
+	if len(b) != 8 {
+		return nil, errors.New("invalid testTenantUser key")
+	}
+	return testTenantUser{binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])}, nil
+}
+
+func init() {
+	RegisterKeyCodec(0x20, testTenantUser{}, testTenantUserCodec{})
+}
+
+func Test_keyCodec(t *testing.T) {
+	keys := []interface{}{
+		testTenantUser{TenantID: 1, UserID: 2},
+		[16]byte{1, 2, 3},
+		netip.MustParseAddr("2001:db8::1"),
+	}
+	for _, format := range []int{BackupFormatLegacy, BackupFormatCompact} {
+		r := NewRule()
+		r.AddRule(time.Minute, 10)
+		r.SetSaveOptions(SaveOptions{Format: format})
+		for _, key := range keys {
+			r.AllowVisit(key)
+		}
+		var buf bytes.Buffer
+		if err := r.SaveTo(&buf); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		restored := NewRule()
+		restored.AddRule(time.Minute, 10)
+		if err := restored.LoadFrom(&buf); err != nil {
+			t.Fatalf("format %d: %v", format, err)
+		}
+		for _, key := range keys {
+			if got := restored.RemainingVisit(key); got != 9 {
+				t.Fatalf("format %d: remaining visits of %v; got %d want %d", format, key, got, 9)
+			}
+		}
+	}
+}
+
+func Test_keyCodecUnregistered(t *testing.T) {
+	type unregistered struct{ id int }
+	r := NewRule()
+	r.AddRule(time.Minute, 10)
+	r.AllowVisit(unregistered{1})
+	if err := r.SaveTo(new(bytes.Buffer)); err == nil {
+		t.Fatal("expected an error when saving an unregistered key type")
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"hash/maphash"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+用户key到其访问记录队列的索引,按key的哈希值分为keyIndexShardNum个分片,每个分片有自己的锁及索引,
+新用户的加入以及过期用户的删除只需锁定其所在的分片,不会阻塞其它分片中用户的访问。
+各分片的索引在第一个用户加入时才创建,所以为每个租户创建的大量小规模Rule中未使用的分片只占用很少的内存。
+队列回收后可能分配给其它用户甚至其它Rule(见queuePool.go),其key随之改变,所以持有队列的一方在加锁后需确认队列仍属于该用户(见lockFor),否则重新获取
+*/
+
+//分片数量,须为2的幂
+const keyIndexShardNum = 64
+
+type keyIndexShard struct {
+	locker sync.RWMutex
+	queues map[interface{}]*autoGrowCircleQueueInt64 //已使用的队列,key代表用户名或IP
+	peak   int                                       //上次重建索引以来queues中最多时的用户数
+	expiry expiryHeap                                //各用户下一次需要检查是否过期的时间,见expiry.go
+	//该分片中的用户被允许及被拒绝的访问次数,分散在各分片中计数以免各协程争用同一个计数器,见metrics.go
+	allowed atomic.Uint64
+	denied  atomic.Uint64
+	_       [64]byte //避免相邻分片的锁位于同一缓存行
+}
+
+//用户数低于高峰时的1/compactOccupancy时,对分片做压缩
+const compactOccupancy = 4
+
+//用户数不超过此值的分片不需要重建索引
+const compactMinPeak = 64
+
+var keyIndexSeed = maphash.MakeSeed()
+
+//按预计的在线用户数,每个分片的索引初始的容量
+func (s *singleRule) preallocatedPerShard() int {
+	return (s.estimatedNumberOfOnlineUsers + keyIndexShardNum - 1) / keyIndexShardNum
+}
+
+//key所在的分片
+func (s *singleRule) shardOf(key interface{}) *keyIndexShard {
+	return &s.shards[keyHash(key)&(keyIndexShardNum-1)]
+}
+
+//key的哈希值,最常用的string及整数类型单独计算哈希值,以免装箱及反射的开销,近似规则(见sketchRule.go)也使用此哈希值
+func keyHash(key interface{}) uint64 {
+	var h uint64
+	switch k := key.(type) {
+	case string:
+		h = maphash.String(keyIndexSeed, k)
+	case int:
+		h = mixUint64(uint64(k))
+	case int8:
+		h = mixUint64(uint64(k))
+	case int16:
+		h = mixUint64(uint64(k))
+	case int32:
+		h = mixUint64(uint64(k))
+	case int64:
+		h = mixUint64(uint64(k))
+	case uint:
+		h = mixUint64(uint64(k))
+	case uint8:
+		h = mixUint64(uint64(k))
+	case uint16:
+		h = mixUint64(uint64(k))
+	case uint32:
+		h = mixUint64(uint64(k))
+	case uint64:
+		h = mixUint64(k)
+	case [16]byte:
+		h = maphash.Bytes(keyIndexSeed, k[:])
+	case netip.Addr:
+		b := k.As16()
+		h = maphash.Bytes(keyIndexSeed, b[:])
+	default:
+		h = maphash.Comparable(keyIndexSeed, key)
+	}
+	return h
+}
+
+//string类型的key所在的分片,与shardOf一致
+func (s *singleRule) shardOfString(key string) *keyIndexShard {
+	return &s.shards[maphash.String(keyIndexSeed, key)&(keyIndexShardNum-1)]
+}
+
+//uint64类型的key所在的分片,与shardOf一致
+func (s *singleRule) shardOfUint64(key uint64) *keyIndexShard {
+	return &s.shards[mixUint64(key)&(keyIndexShardNum-1)]
+}
+
+//整数key的哈希值,使相邻的整数(例如自增ID,同一网段的IP)均匀分布到各分片
+func mixUint64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb3f99e228b75
+	x ^= x >> 33
+	return x
+}
+
+//返回key对应的队列,不存在时返回nil
+func (s *singleRule) lookup(key interface{}) *autoGrowCircleQueueInt64 {
+	return s.shardOf(key).get(key)
+}
+
+//分片中key对应的队列,不存在时返回nil,key只用于查找,不会因此装箱到堆上,见AllowVisitString
+func (sh *keyIndexShard) get(key interface{}) *autoGrowCircleQueueInt64 {
+	sh.locker.RLock()
+	q := sh.queues[key]
+	sh.locker.RUnlock()
+	return q
+}
+
+//按访问的结果计数,返回err
+func (sh *keyIndexShard) counted(err error) error {
+	if err == nil {
+		sh.allowed.Add(1)
+	} else {
+		sh.denied.Add(1)
+	}
+	return err
+}
+
+//返回key对应的队列,不存在时优先使用缓存的空闲队列,
+//admit为true时新用户需先经过用户数及内存限制的检查(见keyLimit.go),被拒绝时返回nil
+func (s *singleRule) queueOf(key interface{}, admit bool) *autoGrowCircleQueueInt64 {
+	return s.queueIn(s.shardOf(key), key, admit)
+}
+
+//与queueOf相同,sh为key所在的分片
+func (s *singleRule) queueIn(sh *keyIndexShard, key interface{}, admit bool) *autoGrowCircleQueueInt64 {
+	//大部分情况下是读，只有少部分情况下是写
+	sh.locker.RLock()
+	q, exist := sh.queues[key]
+	sh.locker.RUnlock()
+	if exist {
+		return q
+	}
+	if admit && !s.admit() {
+		return nil
+	}
+	sh.locker.Lock()
+	if q, exist = sh.queues[key]; exist {
+		sh.locker.Unlock()
+		return q
+	}
+	//分片中第一个用户加入时才创建索引
+	if sh.queues == nil {
+		sh.queues = make(map[interface{}]*autoGrowCircleQueueInt64, s.preallocatedPerShard())
+	}
+	q = getQueue(s.numberOfAllowedAccesses, s.resolution)
+	s.limit.bytes.Add(queueBytes(q))
+	q.locker.Lock()
+	q.owner = s
+	q.key = key
+	gen := q.gen
+	q.locker.Unlock()
+	sh.queues[key] = q
+	sh.schedule(expiryEntry{due: nowUnixNano() + int64(s.defaultExpiration), key: key, q: q, gen: gen})
+	if len(sh.queues) > sh.peak {
+		sh.peak = len(sh.queues)
+	}
+	s.keyNum.Add(1)
+	sh.locker.Unlock()
+	s.notifyKey(key, Observer.OnKeyTracked)
+	return q
+}
+
+//经过一段时间无访问数据时，删除该用户并回收其队列,加锁后队列中又有了新的访问记录时不删除,
+//返回是否由本次调用删除,以及调用后该用户是否已不存在(包括之前已被其它协程删除)
+func (s *singleRule) releaseIfEmpty(key interface{}) (released, gone bool) {
+	sh := s.shardOf(key)
+	sh.locker.Lock()
+	defer sh.locker.Unlock()
+	q, exist := sh.queues[key]
+	if !exist {
+		return false, true
+	}
+	q.locker.Lock()
+	if q.usedSize() != 0 {
+		q.locker.Unlock()
+		return false, false
+	}
+	s.recycle(sh, key, q)
+	q.locker.Unlock()
+	putQueue(q)
+	return true, true
+}
+
+//依次遍历所有用户及其队列,每次只短暂持有一个分片的读锁以复制其中的用户,调用fn时不持有分片的锁,fn返回false时停止遍历
+func (s *singleRule) rangeKeys(fn func(key interface{}, q *autoGrowCircleQueueInt64) bool) {
+	var keys []interface{}
+	var queues []*autoGrowCircleQueueInt64
+	for i := range s.shards {
+		sh := &s.shards[i]
+		keys, queues = keys[:0], queues[:0]
+		sh.locker.RLock()
+		for key, q := range sh.queues {
+			keys = append(keys, key)
+			queues = append(queues, q)
+		}
+		sh.locker.RUnlock()
+		for ii, key := range keys {
+			if !fn(key, queues[ii]) {
+				return
+			}
+		}
+	}
+}
+
+/*
+访问量高峰(例如受到攻击)过后,大量用户过期,map删除元素后也不会缩小,过期检查的堆也保持高峰时的容量,并留有已删除用户的记录,
+所以在每次清除过期数据后检查各分片,用户数远低于高峰时重建索引及堆,以释放其占用的内存。
+回收的队列缓存在sync.Pool中(见queuePool.go),由GC自动释放
+*/
+func (s *singleRule) compact() {
+	perShard := s.preallocatedPerShard()
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.locker.Lock()
+		used := len(sh.queues)
+		if sh.peak > compactMinPeak && used*compactOccupancy < sh.peak {
+			queues := make(map[interface{}]*autoGrowCircleQueueInt64, max(perShard, used))
+			for key, q := range sh.queues {
+				queues[key] = q
+			}
+			sh.queues = queues
+			sh.peak = used
+		}
+		//已删除的用户在堆中的记录要到期时才会丢弃,远多于用户数时提前清理
+		if cap(sh.expiry) > compactMinPeak && used*compactOccupancy < cap(sh.expiry) {
+			sh.expiry = sh.expiry.live(sh.queues)
+		}
+		sh.locker.Unlock()
+	}
+}
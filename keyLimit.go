@@ -0,0 +1,215 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+/*
+限制每个Rule保存的用户数及访问记录占用的内存,防止伪造的IP或随机用户名大量涌入时内存无限增长。
+超出限制时按KeyLimit.Eviction淘汰已有用户或拒绝新用户,被淘汰的用户其访问记录随之清空,再次访问时视为新用户。
+淘汰时并不精确查找最久未访问或访问最少的用户,而是随机取样若干个用户,从中选出一个,以免为每次访问维护额外的数据结构
+*/
+
+//超出限制时的处理方式
+const (
+	EvictLRU       = iota //近似(取样)的LRU:从随机取样的evictionSamples个用户中淘汰最近一次访问时间最早的
+	EvictLeastUsed        //近似(取样)的LFU:从随机取样的evictionSamples个用户中淘汰计时周期内访问次数最少的
+	EvictRejectNew        //不淘汰已有用户,拒绝新用户的访问
+)
+
+//每次淘汰时取样的用户数
+const evictionSamples = 5
+
+//每个分片最多取样的用户数,分片数少于evictionSamples时从一个分片中取样多个用户,以保证取样的总数
+const evictionSamplesPerShard = (evictionSamples + keyIndexShardNum - 1) / keyIndexShardNum
+
+//除访问记录本身外,每个用户在队列结构体,索引等方面大致占用的内存
+const queueOverheadBytes = 160
+
+//用户数及内存限制,为0的字段表示不限制
+type KeyLimit struct {
+	MaxKeys  int   //每条规则最多保存的用户数
+	MaxBytes int64 //所有规则的访问记录加起来大致最多占用的内存
+	Eviction int   //超出限制时的处理方式,默认为EvictLRU(近似)
+}
+
+//用户数及内存的统计数据,由Rule.KeyStatistics返回
+type KeyStatistics struct {
+	Keys         int   //当前保存的用户数,各条规则分别计数
+	Bytes        int64 //访问记录大致占用的内存
+	Evictions    int64 //因超出限制而被淘汰的用户数,各条规则分别计数
+	RejectedKeys int64 //因超出限制而被拒绝的新用户访问次数,各条规则分别计数
+}
+
+//同一Rule的各条规则共用的限制及计数
+type keyLimit struct {
+	config    atomic.Pointer[KeyLimit]
+	bytes     atomic.Int64
+	evictions atomic.Int64
+	rejected  atomic.Int64
+}
+
+/*
+设置用户数及内存限制,可在运行期间随时调整,例:
+r.SetKeyLimit(ratelimit.KeyLimit{MaxKeys: 100000, MaxBytes: 64 << 20, Eviction: ratelimit.EvictLRU})
+表示每条规则最多保存10万个用户,所有规则的访问记录最多大约占用64MB内存,超出时在随机取样的用户中淘汰最久未访问的一个。
+从备份文件加载数据时不受此限制,加载后新用户访问时再按限制淘汰
+*/
+func (r *Rule) SetKeyLimit(limit KeyLimit) {
+	r.mustBeWritable()
+	if limit.MaxKeys < 0 || limit.MaxBytes < 0 {
+		panic("MaxKeys and MaxBytes can't be negative")
+	}
+	switch limit.Eviction {
+	case EvictLRU, EvictLeastUsed, EvictRejectNew:
+	default:
+		panic("unknown eviction policy")
+	}
+	r.keyLimiter().config.Store(&limit)
+}
+
+//当前保存的用户数,访问记录大致占用的内存以及淘汰的用户数
+func (r *Rule) KeyStatistics() KeyStatistics {
+	var stats KeyStatistics
+	if r.limit == nil {
+		return stats
+	}
+	stats.Bytes = r.limit.bytes.Load()
+	stats.Evictions = r.limit.evictions.Load()
+	stats.RejectedKeys = r.limit.rejected.Load()
+	for _, s := range r.rules {
+		stats.Keys += int(s.keyNum.Load())
+	}
+	return stats
+}
+
+//各条规则共用的限制,首次使用时创建
+func (r *Rule) keyLimiter() *keyLimit {
+	if r.limit == nil {
+		r.limit = new(keyLimit)
+	}
+	return r.limit
+}
+
+//队列大致占用的内存
+func queueBytes(q *autoGrowCircleQueueInt64) int64 {
+	return q.storageBytes() + queueOverheadBytes
+}
+
+//是否超出限制
+func (s *singleRule) overLimit(config *KeyLimit) bool {
+	return config.MaxKeys > 0 && s.keyNum.Load() >= int64(config.MaxKeys) ||
+		config.MaxBytes > 0 && s.limit.bytes.Load() >= config.MaxBytes
+}
+
+//新用户加入前调用,超出限制时淘汰已有用户,返回false表示拒绝新用户。
+//调用时不能持有任何分片的锁,淘汰期间其它协程仍可能加入新用户,所以限制只是大致的
+func (s *singleRule) admit() bool {
+	config := s.limit.config.Load()
+	if config == nil {
+		return true
+	}
+	for tries := 0; s.overLimit(config); tries++ {
+		if config.Eviction == EvictRejectNew {
+			s.limit.rejected.Add(1)
+			return false
+		}
+		//没有可淘汰的用户或并发加入的用户过多时,放弃淘汰
+		if tries >= evictionSamples || !s.evictOne(config.Eviction) {
+			return true
+		}
+	}
+	return true
+}
+
+//被取样的用户
+type evictionCandidate struct {
+	key    interface{}
+	q      *autoGrowCircleQueueInt64
+	newest int64 //最近一次访问产生的访问记录,没有访问记录时为0
+	used   int   //计时周期内的访问次数
+}
+
+//按淘汰方式判断c是否比other更应该被淘汰
+func (c *evictionCandidate) before(other *evictionCandidate, eviction int) bool {
+	if eviction == EvictLeastUsed && c.used != other.used {
+		return c.used < other.used
+	}
+	return c.newest < other.newest
+}
+
+//从随机的分片开始,每个分片取evictionSamplesPerShard个用户,共取样evictionSamples个用户,淘汰其中最应该被淘汰的一个,
+//用户数不超过evictionSamples时所有用户都会被取样
+func (s *singleRule) evictOne(eviction int) bool {
+	var victim evictionCandidate
+	sampled := 0
+	start := rand.IntN(keyIndexShardNum)
+	for i := 0; i < keyIndexShardNum && sampled < evictionSamples; i++ {
+		sh := &s.shards[(start+i)&(keyIndexShardNum-1)]
+		sh.locker.RLock()
+		//map的遍历顺序是随机的,取前几个即可
+		taken := 0
+		for key, q := range sh.queues {
+			if taken == evictionSamplesPerShard || sampled == evictionSamples {
+				break
+			}
+			c := evictionCandidate{key: key, q: q}
+			q.locker.Lock()
+			c.used = q.usedSize()
+			if c.used > 0 {
+				c.newest = q.newest()
+			}
+			q.locker.Unlock()
+			if sampled == 0 || c.before(&victim, eviction) {
+				victim = c
+			}
+			sampled++
+			taken++
+		}
+		sh.locker.RUnlock()
+	}
+	if sampled == 0 {
+		return false
+	}
+	if !s.evict(victim.key, victim.q) {
+		return false
+	}
+	s.notifyKey(victim.key, Observer.OnKeyEvicted)
+	return true
+}
+
+//淘汰用户,队列在取样后已被回收或分配给其它用户时返回false
+func (s *singleRule) evict(key interface{}, victim *autoGrowCircleQueueInt64) bool {
+	sh := s.shardOf(key)
+	sh.locker.Lock()
+	defer sh.locker.Unlock()
+	if q, exist := sh.queues[key]; !exist || q != victim {
+		return false
+	}
+	victim.locker.Lock()
+	victim.clear()
+	s.recycle(sh, key, victim)
+	victim.locker.Unlock()
+	putQueue(victim)
+	s.limit.evictions.Add(1)
+	return true
+}
+
+//从分片中删除用户,调用者需持有分片及队列的锁,释放队列的锁后再由putQueue缓存队列
+func (s *singleRule) recycle(sh *keyIndexShard, key interface{}, q *autoGrowCircleQueueInt64) {
+	s.limit.bytes.Add(-queueBytes(q))
+	//回收前，检察空间大小，太大的话，需要清理空间,把空间缩小到默认大小
+	q.reSet()
+	q.owner = nil
+	q.key = nil
+	q.gen++
+	delete(sh.queues, key)
+	s.keyNum.Add(-1)
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_keyLimitEviction(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Minute, 10)
+	r.SetKeyLimit(KeyLimit{MaxKeys: 50})
+	for i := 0; i < 200; i++ {
+		if !r.AllowVisit("user_" + strconv.Itoa(i)) {
+			t.Fatalf("user_%d: expected new keys to be allowed", i)
+		}
+	}
+	stats := r.KeyStatistics()
+	if stats.Keys != 50 || stats.Evictions != 150 || stats.RejectedKeys != 0 {
+		t.Fatalf("unexpected statistics: %+v", stats)
+	}
+}
+
+func Test_keyLimitRejectNew(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Minute, 10)
+	r.SetKeyLimit(KeyLimit{MaxKeys: 2, Eviction: EvictRejectNew})
+	if !r.AllowVisit("a") || !r.AllowVisit("b") {
+		t.Fatal("expected keys under the limit to be allowed")
+	}
+	if r.AllowVisit("c") {
+		t.Fatal("expected new key over the limit to be rejected")
+	}
+	if !r.AllowVisit("a") {
+		t.Fatal("expected existing key to be allowed")
+	}
+	if stats := r.KeyStatistics(); stats.Keys != 2 || stats.RejectedKeys != 1 || stats.Evictions != 0 {
+		t.Fatalf("unexpected statistics: %+v", stats)
+	}
+}
+
+func Test_keyLimitBytes(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Minute, 10)
+	const maxBytes = 20000
+	r.SetKeyLimit(KeyLimit{MaxBytes: maxBytes, Eviction: EvictLeastUsed})
+	for i := 0; i < 1000; i++ {
+		r.AllowVisit(int64(i))
+	}
+	//每个新用户最多使其超出一个队列的大小
+	stats := r.KeyStatistics()
+	if stats.Bytes > maxBytes+queueBytes(newAutoGrowCircleQueueInt64(10, 0)) || stats.Evictions == 0 {
+		t.Fatalf("unexpected statistics: %+v", stats)
+	}
+}
+
+//用户数不超过evictionSamples时全部被取样,淘汰的一定是最应该被淘汰的用户
+func Test_keyLimitEvictOldest(t *testing.T) {
+	for _, eviction := range []int{EvictLRU, EvictLeastUsed} {
+		for i := 0; i < 20; i++ {
+			r := NewRule()
+			r.AddRule(time.Minute, 10)
+			r.SetKeyLimit(KeyLimit{MaxKeys: evictionSamples - 1, Eviction: eviction})
+			for ii := 0; ii < evictionSamples-1; ii++ {
+				r.AllowVisit(ii)
+			}
+			//用户1成为最近一次访问时间最早及访问次数最少的用户
+			for ii := 0; ii < evictionSamples-1; ii++ {
+				if ii != 1 {
+					r.AllowVisit(ii)
+				}
+			}
+			r.AllowVisit("new")
+			if r.RemainingVisits(1)[0] != 10 {
+				t.Fatalf("eviction %d: expected key 1 to be evicted", eviction)
+			}
+			for ii := 0; ii < evictionSamples-1; ii++ {
+				if ii != 1 && r.RemainingVisits(ii)[0] != 8 {
+					t.Fatalf("eviction %d: expected key %d to be kept", eviction, ii)
+				}
+			}
+		}
+	}
+}
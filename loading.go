@@ -8,120 +8,122 @@ package ratelimit
 
 import (
 	"fmt"
-	"github.com/yudeguang/iox"
-	"io/ioutil"
-	"strconv"
+	"io"
+	"os"
 	"time"
 )
 
-//从本地磁盘加载历史数据
+//从本地磁盘加载历史数据,备份文件的格式及压缩方式自动识别
 func (r *Rule) loading() (err error) {
-	var errFileDifferent = fmt.Errorf("backup rules is inconsistent with current rules")
-	b, err := ioutil.ReadFile(r.backupFileName + ".ratelimit")
+	f, err := os.Open(r.backupFileName + ".ratelimit")
 	if err != nil {
-		return fmt.Errorf("Open backup file fail," + err.Error())
+		return fmt.Errorf("Open backup file fail,%v", err)
 	}
-	rs := iox.NewReadSeekerFromBytes(b)
-	rulesNum, err := rs.ReadUint64()
+	defer f.Close()
+	return r.LoadFrom(f)
+}
+
+/*
+从rd中加载由SaveTo或SaveToDiscOnce生成的备份数据,备份数据的格式及压缩方式自动识别,
+不依赖LoadingAndAutoSaveToDisc,只能在程序初始化,还未有用户访问时调用,例:
+err := r.LoadFrom(bytes.NewReader(b))
+*/
+func (r *Rule) LoadFrom(rd io.Reader) error {
+	if len(r.rules) == 0 {
+		panic("rule is empty，please add rule by AddRule")
+	}
+	start := time.Now()
+	var stats BackupStatistics
+	s, err := readSnapshot(rd)
+	if err == nil {
+		stats, err = r.load(s)
+	}
+	r.loadMetric.observe(start, err)
+	r.notifyLoad(stats, err)
+	return err
+}
+
+//加载解析出来的备份数据,并记录及返回加载的统计数据
+func (r *Rule) load(s *snapshot) (BackupStatistics, error) {
+	r.mustBeWritable()
+	r.lockerForBackup.Lock()
+	defer r.lockerForBackup.Unlock()
+	stats, err := r.restore(s, clockNow())
 	if err != nil {
-		return err
+		return BackupStatistics{}, err
 	}
+	r.lastLoad = stats
+	return stats, nil
+}
+
+//把解析出来的备份数据加入到各规则中,先全部校验通过后再加入,以免加载到一半出错时留下不完整的数据
+//相对于now已过期的访问记录不再加入,没有未过期访问记录的用户也不再加入,now一般为加载时的时间
+func (r *Rule) restore(s *snapshot, now time.Time) (BackupStatistics, error) {
+	if err := r.verify(s, now, r.saveOptions); err != nil {
+		return BackupStatistics{Time: now}, err
+	}
+	return r.apply(s, now, r.saveOptions)
+}
+
+//校验备份数据是否可以加载到各规则中
+func (r *Rule) verify(s *snapshot, now time.Time, opts SaveOptions) error {
 	//1 判断规则数量是否一致
-	if int(rulesNum) != len(r.rules) {
-		return errFileDifferent
+	if len(s.rules) != len(r.rules) {
+		return errBackupRulesDifferent
 	}
-	for i := range r.rules {
-		now := time.Now().Add(r.rules[i].defaultExpiration).UnixNano()
-		//2 判断单条规则的下标一致
-		curIndex, err := rs.ReadUint64()
-		if err != nil {
-			return err
+	for i, sr := range s.rules {
+		//2 判断单条规则的下标一致,紧凑格式中还记录了计时周期,也需一致
+		if sr.index != i {
+			return errBackupRulesDifferent
 		}
-		if i != int(curIndex) {
-			return errFileDifferent
+		if sr.expiration != 0 && sr.expiration != r.rules[i].defaultExpiration {
+			return errBackupRulesDifferent
 		}
-
-		curRuleKeyNum, err := rs.ReadUint64()
-		if err != nil {
-			return err
+		//3 访问记录的值不能太大，大过当前时间加上过期时间,允许超出ClockSkewTolerance,设置了ClampFutureRecords时不检查
+		max := now.Add(r.rules[i].defaultExpiration + opts.ClockSkewTolerance).UnixNano()
+		for _, k := range sr.keys {
+			if r.rules[i].exists(k.key) {
+				panic("The function LoadingAndAutoSaveToDisc or LoadFrom can only be called when the program is initialized,and can only be called once.")
+			}
+			if !opts.ClampFutureRecords && len(k.records) > 0 && k.records[len(k.records)-1] > max {
+				return fmt.Errorf("The backup file has been illegally modified and has become invalid,the location is:%d,"+
+					"record %s is later than %s,if the clock is behind the one that saved the backup,please set ClockSkewTolerance or ClampFutureRecords of SaveOptions",
+					k.offset, time.Unix(0, k.records[len(k.records)-1]).Format(time.RFC3339Nano), time.Unix(0, max).Format(time.RFC3339Nano))
+			}
+			//4 未过期的访问记录数不能超过当前规则允许的访问次数
+			if visits := len(k.records) - expiredPrefix(k.records, now.UnixNano()); visits > r.rules[i].numberOfAllowedAccesses {
+				return fmt.Errorf("%v has %d visits,more than the %d allowed within %v,the location is:%d", k.key, visits, r.rules[i].numberOfAllowedAccesses, r.rules[i].defaultExpiration, k.offset)
+			}
 		}
-		//有可能某条规则下面暂时没有历史记录
-		if int(curRuleKeyNum) > 0 {
-			for ii := 0; ii < int(curRuleKeyNum); ii++ {
-				//获取键类型,以下每种类型对应存盘时的相应定义
-				KeyType, err := rs.ReadUint8()
-				if err == nil {
-					var key interface{}
-					var tempKey uint64
-					switch KeyType {
-					// string
-					case 0:
-						key, err = rs.ReadStringUint64()
-					case 1:
-						tempKey, err = rs.ReadUint64()
-						key = int(tempKey)
-					case 2:
-						tempKey, err = rs.ReadUint64()
-						key = int8(tempKey)
-					case 3:
-						tempKey, err = rs.ReadUint64()
-						key = int16(tempKey)
-					//int32
-					case 4:
-						tempKey, err = rs.ReadUint64()
-						key = int32(tempKey)
-					case 5:
-						tempKey, err = rs.ReadUint64()
-						key = int64(tempKey)
-					case 6:
-						tempKey, err = rs.ReadUint64()
-						key = uint(tempKey)
-					case 7:
-						tempKey, err = rs.ReadUint64()
-						key = uint8(tempKey)
-					case 8:
-						tempKey, err = rs.ReadUint64()
-						key = uint16(tempKey)
-					case 9:
-						tempKey, err = rs.ReadUint64()
-						key = uint32(tempKey)
-					case 10:
-						tempKey, err = rs.ReadUint64()
-						key = tempKey
-					default:
-						return errFileDifferent
-					}
-					if err != nil {
-						return err
-					}
-					if _, exist := r.rules[i].usedVisitorRecordsIndex.Load(key); exist {
-						panic("The function LoadingAndAutoSaveToDisc can only be called when the program is initialized,and can only be called once.")
-					}
-					curKeyRecordsNum, err := rs.ReadUint64()
-					if err != nil {
-						return err
-					}
-					var preRecord int64
-					for iii := 0; iii < int(curKeyRecordsNum); iii++ {
-						record, err := rs.ReadUint64()
-						if err != nil {
-							return err
-						}
-						curRecord := int64(record)
-						//curRecord必须依次变大，否则不合法,另外,curRecord的值也不能太大，大过当前时间加上过期时间
-						location, _ := rs.CurPos()
-						if curRecord < preRecord || curRecord > now {
-							return fmt.Errorf("The backup file has been illegally modified and has become invalid,the location is:" + strconv.Itoa(int(location)))
-						}
-						err = r.rules[i].addFromBackUpFile(key, int64(record))
-						if err != nil {
-							return err
-						}
-						preRecord = curRecord
-					}
+	}
+	return nil
+}
+
+//把已校验的备份数据加入到各规则中
+func (r *Rule) apply(s *snapshot, now time.Time, opts SaveOptions) (stats BackupStatistics, err error) {
+	stats.Time = now
+	for i, sr := range s.rules {
+		max := now.Add(r.rules[i].defaultExpiration + opts.ClockSkewTolerance).UnixNano()
+		for _, k := range sr.keys {
+			expired := expiredPrefix(k.records, now.UnixNano())
+			stats.SkippedExpiredRecords += expired
+			if expired == len(k.records) {
+				stats.SkippedEmptyKeys++
+				continue
+			}
+			for _, record := range k.records[expired:] {
+				//访问记录依次变大,调整为允许的最大值后仍保持顺序
+				if opts.ClampFutureRecords && record > max {
+					record = max
+					stats.ClampedRecords++
+				}
+				if err = r.rules[i].addFromBackUpFile(k.key, record); err != nil {
+					return stats, err
 				}
 			}
+			stats.Keys++
+			stats.Records += len(k.records) - expired
 		}
 	}
-	return nil
+	return stats, nil
 }
@@ -0,0 +1,206 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+以Prometheus文本格式输出各Rule的监控指标,不依赖Prometheus的客户端库,例:
+paid.SetName("paid")
+free.SetName("free")
+http.Handle("/metrics", ratelimit.MetricsHandler(paid, free))
+输出的指标:
+ratelimit_rule_visits_total{rule,result}             各Rule允许(result="allowed")及拒绝(result="denied")的访问次数
+ratelimit_visits_total{rule,window,mode,result}      各条规则允许及拒绝的访问次数,mode为exact(AddRule)或approximate(AddApproximateRule)
+ratelimit_tracked_keys{rule,window}                  各条规则当前保存的用户数
+ratelimit_record_bytes{rule}                         访问记录大致占用的内存,见KeyStatistics
+ratelimit_evictions_total{rule}                      因超出SetKeyLimit的限制而被淘汰的用户数
+ratelimit_rejected_keys_total{rule}                  因超出SetKeyLimit的限制而被拒绝的新用户访问次数
+ratelimit_cleanup_duration_seconds{rule,window}      清除过期数据的耗时
+ratelimit_save_duration_seconds{rule}                存盘的耗时
+ratelimit_save_failures_total{rule}                  存盘失败的次数
+ratelimit_load_duration_seconds{rule}                加载备份数据的耗时
+ratelimit_load_failures_total{rule}                  加载备份数据失败的次数
+其中window为计时周期,例如1m0s,耗时以summary类型输出_sum及_count。
+前面的规则拒绝访问后,后面的规则不再计数,所以各条规则的计数不等于Rule的访问次数,Rule的访问次数见ratelimit_rule_visits_total。
+各Rule需用SetName设置不同的名称,否则输出的指标标签相同,Prometheus会拒绝本次采集,所以名称为空或重复时panic
+*/
+func MetricsHandler(rules ...*Rule) http.Handler {
+	if err := checkMetricNames(rules); err != nil {
+		panic(err)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		//创建之后又用SetName修改了名称
+		if err := checkMetricNames(rules); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteMetrics(w, rules...)
+	})
+}
+
+//各Rule的名称不能为空,也不能重复
+func checkMetricNames(rules []*Rule) error {
+	names := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		if r.name == "" {
+			return errors.New("the rule has no name,please set it by SetName")
+		}
+		if names[r.name] {
+			return errors.New(`duplicate rule name "` + r.name + `"`)
+		}
+		names[r.name] = true
+	}
+	return nil
+}
+
+/*
+设置规则名称,作为监控指标中rule标签的值,以区分付费用户、免费用户、匿名用户等不同的Rule,例:
+r.SetName("paid")
+加入Store且未设置名称的Rule以其在Store中的名称作为规则名称
+*/
+func (r *Rule) SetName(name string) {
+	r.name = name
+}
+
+//耗时及失败次数
+type durationMetric struct {
+	count    atomic.Uint64
+	failures atomic.Uint64
+	nanos    atomic.Int64
+}
+
+//按访问的结果计数,见ratelimit_rule_visits_total
+func (r *Rule) counted(allowed bool) bool {
+	if allowed {
+		r.allowed.Add(1)
+	} else {
+		r.denied.Add(1)
+	}
+	return allowed
+}
+
+//记录一次从start开始的操作,err不为nil时计为失败
+func (m *durationMetric) observe(start time.Time, err error) {
+	m.nanos.Add(int64(time.Since(start)))
+	m.count.Add(1)
+	if err != nil {
+		m.failures.Add(1)
+	}
+}
+
+//某一个指标的输出,HELP及TYPE在所有Rule之前输出一次
+type metricFamily struct {
+	name    string
+	help    string
+	typ     string
+	samples func(r *Rule, emit func(suffix, labels string, value float64))
+}
+
+var metricFamilies = []metricFamily{
+	{"ratelimit_rule_visits_total", "Visits allowed or denied by each rule.", "counter", func(r *Rule, emit func(string, string, float64)) {
+		emit("", r.ruleLabel()+`,result="allowed"`, float64(r.allowed.Load()))
+		emit("", r.ruleLabel()+`,result="denied"`, float64(r.denied.Load()))
+	}},
+	{"ratelimit_visits_total", "Visits allowed or denied by each rule window.", "counter", func(r *Rule, emit func(string, string, float64)) {
+		for _, s := range r.rules {
+			var allowed, denied uint64
+			for i := range s.shards {
+				allowed += s.shards[i].allowed.Load()
+				denied += s.shards[i].denied.Load()
+			}
+			emit("", r.windowLabels(s.defaultExpiration)+`,mode="exact",result="allowed"`, float64(allowed))
+			emit("", r.windowLabels(s.defaultExpiration)+`,mode="exact",result="denied"`, float64(denied))
+		}
+		for _, s := range r.sketches {
+			emit("", r.windowLabels(s.defaultExpiration)+`,mode="approximate",result="allowed"`, float64(s.allowed.Load()))
+			emit("", r.windowLabels(s.defaultExpiration)+`,mode="approximate",result="denied"`, float64(s.denied.Load()))
+		}
+	}},
+	{"ratelimit_tracked_keys", "Keys currently tracked by each rule window.", "gauge", func(r *Rule, emit func(string, string, float64)) {
+		for _, s := range r.rules {
+			emit("", r.windowLabels(s.defaultExpiration), float64(s.keyNum.Load()))
+		}
+	}},
+	{"ratelimit_record_bytes", "Approximate memory used by visit records.", "gauge", func(r *Rule, emit func(string, string, float64)) {
+		emit("", r.ruleLabel(), float64(r.KeyStatistics().Bytes))
+	}},
+	{"ratelimit_evictions_total", "Keys evicted because of the key limit.", "counter", func(r *Rule, emit func(string, string, float64)) {
+		emit("", r.ruleLabel(), float64(r.KeyStatistics().Evictions))
+	}},
+	{"ratelimit_rejected_keys_total", "Visits of new keys rejected because of the key limit.", "counter", func(r *Rule, emit func(string, string, float64)) {
+		emit("", r.ruleLabel(), float64(r.KeyStatistics().RejectedKeys))
+	}},
+	{"ratelimit_cleanup_duration_seconds", "Time spent deleting expired records.", "summary", func(r *Rule, emit func(string, string, float64)) {
+		for _, s := range r.rules {
+			emitDuration(emit, r.windowLabels(s.defaultExpiration), &s.cleanupMetric)
+		}
+	}},
+	{"ratelimit_save_duration_seconds", "Time spent saving backups.", "summary", func(r *Rule, emit func(string, string, float64)) {
+		emitDuration(emit, r.ruleLabel(), &r.saveMetric)
+	}},
+	{"ratelimit_save_failures_total", "Failed backup saves.", "counter", func(r *Rule, emit func(string, string, float64)) {
+		emit("", r.ruleLabel(), float64(r.saveMetric.failures.Load()))
+	}},
+	{"ratelimit_load_duration_seconds", "Time spent loading backups.", "summary", func(r *Rule, emit func(string, string, float64)) {
+		emitDuration(emit, r.ruleLabel(), &r.loadMetric)
+	}},
+	{"ratelimit_load_failures_total", "Failed backup loads.", "counter", func(r *Rule, emit func(string, string, float64)) {
+		emit("", r.ruleLabel(), float64(r.loadMetric.failures.Load()))
+	}},
+}
+
+//以summary类型输出耗时
+func emitDuration(emit func(string, string, float64), labels string, m *durationMetric) {
+	emit("_sum", labels, time.Duration(m.nanos.Load()).Seconds())
+	emit("_count", labels, float64(m.count.Load()))
+}
+
+//以Prometheus文本格式把各Rule的监控指标写入w,MetricsHandler即调用此函数,Rule的名称为空或重复时返回错误,不写入任何数据
+func WriteMetrics(w io.Writer, rules ...*Rule) error {
+	if err := checkMetricNames(rules); err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for _, f := range metricFamilies {
+		bw.WriteString("# HELP " + f.name + " " + f.help + "\n")
+		bw.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+		for _, r := range rules {
+			f.samples(r, func(suffix, labels string, value float64) {
+				bw.WriteString(f.name + suffix + "{" + labels + "} " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+			})
+		}
+	}
+	return bw.Flush()
+}
+
+//rule标签
+func (r *Rule) ruleLabel() string {
+	return `rule="` + escapeLabelValue(r.name) + `"`
+}
+
+//rule及window标签
+func (r *Rule) windowLabels(window time.Duration) string {
+	return r.ruleLabel() + `,window="` + window.String() + `"`
+}
+
+//标签值中的反斜杠,双引号及换行需要转义
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
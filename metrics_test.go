@@ -0,0 +1,89 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_metricsHandler(t *testing.T) {
+	paid := NewRule()
+	paid.SetName("paid")
+	paid.AddRule(time.Minute, 2)
+	free := NewRule()
+	free.SetName(`free "anonymous"`)
+	free.AddApproximateRule(time.Minute, 1, 64, 2)
+	for i := 0; i < 3; i++ {
+		paid.AllowVisitString("ydg")
+		free.AllowVisit("ydg")
+	}
+	if err := paid.LoadFrom(bytes.NewReader([]byte("invalid"))); err == nil {
+		t.Fatal("expected error for an invalid backup")
+	}
+	var buf bytes.Buffer
+	if err := paid.SaveTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	MetricsHandler(paid, free).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	b, _ := io.ReadAll(rec.Body)
+	body := string(b)
+	for _, want := range []string{
+		`ratelimit_rule_visits_total{rule="paid",result="allowed"} 2`,
+		`ratelimit_rule_visits_total{rule="paid",result="denied"} 1`,
+		`ratelimit_rule_visits_total{rule="free \"anonymous\"",result="allowed"} 1`,
+		`ratelimit_visits_total{rule="paid",window="1m0s",mode="exact",result="allowed"} 2`,
+		`ratelimit_visits_total{rule="paid",window="1m0s",mode="exact",result="denied"} 1`,
+		`ratelimit_visits_total{rule="free \"anonymous\"",window="1m0s",mode="approximate",result="denied"} 2`,
+		`ratelimit_tracked_keys{rule="paid",window="1m0s"} 1`,
+		`ratelimit_save_duration_seconds_count{rule="paid"} 1`,
+		`ratelimit_load_failures_total{rule="paid"} 1`,
+		"# TYPE ratelimit_cleanup_duration_seconds summary\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("expected %q in metrics:\n%s", want, body)
+		}
+	}
+	if strings.Count(body, "# HELP ratelimit_visits_total ") != 1 {
+		t.Fatal("expected HELP once per metric")
+	}
+}
+
+func Test_metricsNames(t *testing.T) {
+	a, b := NewRule(), NewRule()
+	a.AddRule(time.Minute, 2)
+	b.AddRule(time.Minute, 2)
+	var buf bytes.Buffer
+	if err := WriteMetrics(&buf, a, b); err == nil || buf.Len() != 0 {
+		t.Fatal("expected error for rules without names")
+	}
+	a.SetName("paid")
+	b.SetName("paid")
+	if err := WriteMetrics(&buf, a, b); err == nil {
+		t.Fatal("expected error for duplicate names")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected MetricsHandler to panic for duplicate names")
+			}
+		}()
+		MetricsHandler(a, b)
+	}()
+	b.SetName("free")
+	if err := WriteMetrics(&buf, a, b); err != nil {
+		t.Fatal(err)
+	}
+}
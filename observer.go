@@ -0,0 +1,135 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+访问控制事件的观察者,用于记录被拒绝的访问,报警,或把访问数据提供给风控模型等,不必在每个调用AllowVisit的地方另做处理。
+由Rule.AddObserver注册,各回调均在释放队列及分片的锁之后调用,回调中可以调用RemainingVisits等函数,
+但回调是在访问者或清除过期数据的协程中同步执行的,耗时较长的处理应交给其它协程,以免拖慢访问。
+用户相关的事件按规则分别调用,例如有3条规则时,一个新用户会调用3次OnKeyTracked,window为各规则的计时周期。
+只关心部分事件时可嵌入NopObserver
+*/
+type Observer interface {
+	OnAllow(key interface{})                            //允许访问
+	OnDeny(key interface{}, decision Decision)          //拒绝访问,decision为拒绝访问的规则及原因
+	OnKeyTracked(key interface{}, window time.Duration) //新用户加入计时周期为window的规则,从备份文件加载的用户也会调用
+	OnKeyExpired(key interface{}, window time.Duration) //用户的访问记录全部过期,在清除过期数据时被删除
+	OnKeyEvicted(key interface{}, window time.Duration) //用户因超出用户数或内存限制被淘汰,见SetKeyLimit
+	OnSave(stats BackupStatistics, err error)           //存盘完成,失败时err不为nil
+	OnLoad(stats BackupStatistics, err error)           //加载备份数据完成,失败时err不为nil
+}
+
+//拒绝访问的原因
+const (
+	DenyRateLimited = iota //超出规则在计时周期内允许访问的次数
+	DenyTooManyKeys        //新用户因超出用户数或内存限制被拒绝,见SetKeyLimit
+)
+
+//拒绝访问的规则及原因,见Observer.OnDeny
+type Decision struct {
+	Reason      int           //拒绝访问的原因
+	Window      time.Duration //拒绝访问的规则的计时周期
+	Limit       int           //该规则在计时周期内允许访问的次数
+	Approximate bool          //是否为AddApproximateRule增加的近似规则
+}
+
+//不处理任何事件的观察者,嵌入到自己的观察者中后只需实现关心的事件,例:
+//type denyLogger struct{ ratelimit.NopObserver }
+//func (denyLogger) OnDeny(key interface{}, d ratelimit.Decision) { log.Println("deny", key, d.Window) }
+type NopObserver struct{}
+
+func (NopObserver) OnAllow(key interface{})                            {}
+func (NopObserver) OnDeny(key interface{}, decision Decision)          {}
+func (NopObserver) OnKeyTracked(key interface{}, window time.Duration) {}
+func (NopObserver) OnKeyExpired(key interface{}, window time.Duration) {}
+func (NopObserver) OnKeyEvicted(key interface{}, window time.Duration) {}
+func (NopObserver) OnSave(stats BackupStatistics, err error)           {}
+func (NopObserver) OnLoad(stats BackupStatistics, err error)           {}
+
+//同一Rule的各条规则共用的观察者,作为Rule的字段无需创建,注册时复制一份新的列表,回调时无锁读取,所以可以在访问期间注册
+type observerList struct {
+	locker sync.Mutex
+	list   atomic.Pointer[[]Observer]
+}
+
+/*
+注册观察者,可注册多个,按注册的顺序调用,可在运行期间随时注册,例:
+r.AddObserver(myObserver)
+*/
+func (r *Rule) AddObserver(o Observer) {
+	r.mustBeWritable()
+	if o == nil {
+		panic("observer can't be nil")
+	}
+	r.observers.add(o)
+}
+
+func (l *observerList) add(o Observer) {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	old := l.load()
+	list := append(old[:len(old):len(old)], o)
+	l.list.Store(&list)
+}
+
+//已注册的观察者,l为nil时返回nil
+func (l *observerList) load() []Observer {
+	if l == nil {
+		return nil
+	}
+	if list := l.list.Load(); list != nil {
+		return *list
+	}
+	return nil
+}
+
+//通知访问的结果,只在有观察者时调用,以免AllowVisitString等函数为回调装箱key
+func notifyVisit(observers []Observer, key interface{}, decision Decision, allowed bool) {
+	for _, o := range observers {
+		if allowed {
+			o.OnAllow(key)
+		} else {
+			o.OnDeny(key, decision)
+		}
+	}
+}
+
+//通知存盘的结果,调用时不能持有lockerForBackup,以免回调中查询备份统计数据时死锁
+func (r *Rule) notifySave(stats BackupStatistics, err error) {
+	for _, o := range r.observers.load() {
+		o.OnSave(stats, err)
+	}
+}
+
+//通知加载备份数据的结果,与notifySave相同
+func (r *Rule) notifyLoad(stats BackupStatistics, err error) {
+	for _, o := range r.observers.load() {
+		o.OnLoad(stats, err)
+	}
+}
+
+//通知用户相关的事件,event为Observer.OnKeyTracked等,调用时不能持有分片及队列的锁
+func (s *singleRule) notifyKey(key interface{}, event func(Observer, interface{}, time.Duration)) {
+	for _, o := range s.observers.load() {
+		event(o, key, s.defaultExpiration)
+	}
+}
+
+//被规则拒绝访问的原因,err为add返回的错误
+func (s *singleRule) decision(err error) Decision {
+	d := Decision{Reason: DenyRateLimited, Window: s.defaultExpiration, Limit: s.numberOfAllowedAccesses}
+	if err == errTooManyKeys {
+		d.Reason = DenyTooManyKeys
+	}
+	return d
+}
@@ -0,0 +1,155 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+//把事件记录为字符串,r不为nil时在OnDeny中查询剩余访问次数,以确认回调时未持有锁
+type recordingObserver struct {
+	r      *Rule
+	locker sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(format string, args ...interface{}) {
+	o.locker.Lock()
+	o.events = append(o.events, fmt.Sprintf(format, args...))
+	o.locker.Unlock()
+}
+
+func (o *recordingObserver) take() []string {
+	o.locker.Lock()
+	defer o.locker.Unlock()
+	events := o.events
+	o.events = nil
+	return events
+}
+
+func (o *recordingObserver) OnAllow(key interface{}) { o.record("allow %v", key) }
+func (o *recordingObserver) OnDeny(key interface{}, d Decision) {
+	if o.r == nil {
+		o.record("deny %v %d %v %d %v", key, d.Reason, d.Window, d.Limit, d.Approximate)
+		return
+	}
+	o.record("deny %v %d %v %d %v remaining=%d", key, d.Reason, d.Window, d.Limit, d.Approximate, o.r.RemainingVisits(key)[0])
+}
+func (o *recordingObserver) OnKeyTracked(key interface{}, window time.Duration) {
+	o.record("tracked %v %v", key, window)
+}
+func (o *recordingObserver) OnKeyExpired(key interface{}, window time.Duration) {
+	o.record("expired %v %v", key, window)
+}
+func (o *recordingObserver) OnKeyEvicted(key interface{}, window time.Duration) {
+	o.record("evicted %v %v", key, window)
+}
+func (o *recordingObserver) OnSave(stats BackupStatistics, err error) {
+	o.record("save %d %v", stats.Keys, err)
+}
+func (o *recordingObserver) OnLoad(stats BackupStatistics, err error) {
+	o.record("load %d %v", stats.Keys, err)
+}
+
+func Test_observer(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Hour, 2)
+	r.SetKeyLimit(KeyLimit{MaxKeys: 1})
+	o := &recordingObserver{r: r}
+	r.AddObserver(o)
+	r.AllowVisitString("ydg")
+	r.AllowVisitString("ydg")
+	r.AllowVisitString("ydg")
+	r.AllowVisitUint64(7)
+	want := []string{
+		"tracked ydg 1h0m0s", "allow ydg", "allow ydg", "deny ydg 0 1h0m0s 2 false remaining=0",
+		"evicted ydg 1h0m0s", "tracked 7 1h0m0s", "allow 7",
+	}
+	if events := o.take(); !reflect.DeepEqual(events, want) {
+		t.Fatalf("unexpected events %q", events)
+	}
+	var buf bytes.Buffer
+	if err := r.SaveTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if events := o.take(); !reflect.DeepEqual(events, []string{"save 1 <nil>"}) {
+		t.Fatalf("unexpected events %q", events)
+	}
+	loaded := NewRule()
+	loaded.AddRule(time.Hour, 2)
+	lo := &recordingObserver{r: loaded}
+	loaded.AddObserver(lo)
+	if err := loaded.LoadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if events := lo.take(); !reflect.DeepEqual(events, []string{"tracked 7 1h0m0s", "load 1 <nil>"}) {
+		t.Fatalf("unexpected events %q", events)
+	}
+}
+
+func Test_observerApproximate(t *testing.T) {
+	r := NewRule()
+	r.AddApproximateRule(time.Minute, 1, 64, 2)
+	//近似规则不支持RemainingVisits,不在OnDeny中查询
+	o := new(recordingObserver)
+	r.AddObserver(o)
+	r.AllowVisit("ydg")
+	r.AllowVisit("ydg")
+	want := []string{"allow ydg", "deny ydg 0 1m0s 1 true"}
+	if events := o.take(); !reflect.DeepEqual(events, want) {
+		t.Fatalf("unexpected events %q", events)
+	}
+}
+
+func Test_observerExpired(t *testing.T) {
+	l := new(observerList)
+	o := new(recordingObserver)
+	l.add(o)
+	s := createsingleRule(new(keyLimit), l, 0, time.Millisecond*50, time.Second, 10, 0)
+	s.add("ydg")
+	time.Sleep(time.Millisecond * 80)
+	s.deleteExpiredOnce()
+	want := []string{"tracked ydg 50ms", "expired ydg 50ms"}
+	if events := o.take(); !reflect.DeepEqual(events, want) {
+		t.Fatalf("unexpected events %q", events)
+	}
+}
+
+//在并发访问期间注册观察者,由go test -race检查
+func Test_observerAddDuringVisits(t *testing.T) {
+	exact := NewRule()
+	exact.AddRule(time.Minute, 1000)
+	approximate := NewRule()
+	approximate.AddApproximateRule(time.Minute, 1000, 64, 2)
+	for _, r := range []*Rule{exact, approximate} {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for ii := 0; ii < 200; ii++ {
+					r.AllowVisitString("ydg")
+					r.AllowVisitUint64(uint64(ii))
+					r.AllowVisit(ii)
+				}
+			}()
+		}
+		o := new(recordingObserver)
+		r.AddObserver(o)
+		r.AddObserver(NopObserver{})
+		wg.Wait()
+		r.AllowVisitString("andy")
+		if events := o.take(); len(events) == 0 || events[len(events)-1] != "allow andy" {
+			t.Fatalf("expected the observer to be notified,got %d events", len(events))
+		}
+	}
+}
@@ -7,6 +7,7 @@ package ratelimit
 
 import (
 	"errors"
+	"math"
 	"sync"
 	"time"
 )
@@ -15,24 +16,30 @@ import (
 用环形队列做为底层数据结构来存储用户访问数据,并能实现自动增长以及收缩
 */
 
-//使用切片实现的队列
+//使用切片实现的队列,除lockFor外各方法均不加锁,由调用者通过lockFor加锁
+//resolution为0时访问记录以int64存储于visitorRecord中,否则以相对于base的uint32偏移量存储于offsets中,见at及set
 type autoGrowCircleQueueInt64 struct {
-	key interface{}
+	key   interface{} //队列当前所属的用户,空闲时为nil
+	owner *singleRule //队列当前所属的规则,回收的队列可能被其它Rule重新使用,见queuePool.go
+	gen   uint64      //每次回收时加1,用于判断过期检查的记录是否仍然有效,见expiry.go
 	//注意，maxSize比实际存储长度大1
 	maxSize int
-	//maxSizeTemp与visitorRecord长度相同,visitorRecord长度设计根据实际情况成自动增长
+	//maxSizeTemp与visitorRecord(或offsets)长度相同,visitorRecord长度设计根据实际情况成自动增长
 	maxSizeTemp   int
 	visitorRecord []int64
+	offsets       []uint32 //访问记录为base+offset*resolution
+	base          int64
+	resolution    int64
 	head          int //头
 	tail          int //尾
-	//存盘时临时用到的虚拟队列的头和尾
-	headForCopy int
-	tailForCopy int
-	locker      *sync.Mutex
+	locker        *sync.Mutex
 }
 
-//初始化环形队列,长度超过1023的队列暂时只分配1023的空间
-func newAutoGrowCircleQueueInt64(size int) *autoGrowCircleQueueInt64 {
+//队列已满,即在计时周期内的访问次数已达上限
+var errQueueFull = errors.New("queue is full")
+
+//初始化环形队列,长度超过1023的队列暂时只分配1023的空间,resolution不为0时按此精度以uint32存储访问记录
+func newAutoGrowCircleQueueInt64(size int, resolution time.Duration) *autoGrowCircleQueueInt64 {
 	var c autoGrowCircleQueueInt64
 	c.maxSize = size + 1
 	if c.maxSize > 1024 {
@@ -40,18 +47,91 @@ func newAutoGrowCircleQueueInt64(size int) *autoGrowCircleQueueInt64 {
 	} else {
 		c.maxSizeTemp = c.maxSize
 	}
-	c.visitorRecord = make([]int64, c.maxSizeTemp)
+	c.resolution = int64(resolution)
+	c.alloc(c.maxSizeTemp)
 	c.locker = new(sync.Mutex)
 	return &c
 }
 
+//分配长度为n的存储空间
+//不超过1024时容量取2的幂,以便回收后按容量分级缓存,见queuePool.go
+func (q *autoGrowCircleQueueInt64) alloc(n int) {
+	c := n
+	if n <= 1024 {
+		c = 1 << queueClass(n)
+	}
+	if q.resolution == 0 {
+		q.visitorRecord = make([]int64, n, c)
+	} else {
+		q.offsets = make([]uint32, n, c)
+	}
+}
+
+//存储空间占用的内存
+func (q *autoGrowCircleQueueInt64) storageBytes() int64 {
+	return int64(cap(q.visitorRecord))*8 + int64(cap(q.offsets))*4
+}
+
+//第i个位置的访问记录
+func (q *autoGrowCircleQueueInt64) at(i int) int64 {
+	if q.resolution == 0 {
+		return q.visitorRecord[i]
+	}
+	return q.base + int64(q.offsets[i])*q.resolution
+}
+
+//最新的一条访问记录,调用者需确认队列不为空
+func (q *autoGrowCircleQueueInt64) newest() int64 {
+	return q.at((q.tail + q.maxSizeTemp - 1) % q.maxSizeTemp)
+}
+
+/*
+在第i个位置写入访问记录,以uint32存储时向上取整到resolution,访问记录只会推迟而不会提前过期。
+队列为空时以该访问记录为base,偏移量超出uint32时以最早的一条访问记录为新的base,其余偏移量相应减小,
+由于队列中的访问记录最多相差一个计时周期,AddRule时已确认计时周期不超过uint32所能表示的范围
+*/
+func (q *autoGrowCircleQueueInt64) set(i int, val int64) {
+	if q.resolution == 0 {
+		q.visitorRecord[i] = val
+		return
+	}
+	if q.tempQueueIsEmpty() {
+		q.base = val
+	}
+	offset := (val - q.base + q.resolution - 1) / q.resolution
+	if offset > math.MaxUint32 {
+		q.rebase()
+		offset = (val - q.base + q.resolution - 1) / q.resolution
+	}
+	//并发时极小概率出现的比base更早的访问记录,按base记录
+	offset = max(0, min(offset, math.MaxUint32))
+	q.offsets[i] = uint32(offset)
+}
+
+//以最早的一条访问记录为新的base
+func (q *autoGrowCircleQueueInt64) rebase() {
+	delta := q.offsets[q.head]
+	for i, index := 0, q.head; i < q.usedSize(); i++ {
+		q.offsets[index] -= delta
+		index = (index + 1) % q.maxSizeTemp
+	}
+	q.base += int64(delta) * q.resolution
+}
+
+//队列仍属于规则owner中的key时加锁并返回true,调用者用完后需解锁;队列已被回收或者已分配给其它用户时返回false,不加锁
+func (q *autoGrowCircleQueueInt64) lockFor(owner *singleRule, key interface{}) bool {
+	q.locker.Lock()
+	if q.owner != owner || q.key != key {
+		q.locker.Unlock()
+		return false
+	}
+	return true
+}
+
 //队列无人使用时,对于队列实际使用空间长度大于1023的需要对此队列做收缩操作以节省空间
 func (q *autoGrowCircleQueueInt64) reSet() {
-	q.locker.Lock()
-	defer q.locker.Unlock()
 	if q.maxSize > 1024 && q.maxSizeTemp > 1024 {
-		newVisitorRecord := make([]int64, 1024)
-		q.visitorRecord = newVisitorRecord
+		q.alloc(1024)
 		q.maxSizeTemp = 1024
 		q.head = 0
 		q.tail = 0
@@ -71,75 +151,70 @@ func (q *autoGrowCircleQueueInt64) needGrow() bool {
 
 //对队列进行扩容操作
 func (q *autoGrowCircleQueueInt64) grow() {
-	newVisitorRecordLen := len(q.visitorRecord) * 2
+	newVisitorRecordLen := q.maxSizeTemp * 2
 	if newVisitorRecordLen > q.maxSize {
 		newVisitorRecordLen = q.maxSize
 	}
-	newVisitorRecord := make([]int64, newVisitorRecordLen)
-	//复制数据
+	oldVisitorRecord, oldOffsets := q.visitorRecord, q.offsets
+	q.alloc(newVisitorRecordLen)
+	//复制数据,以uint32存储时base不变,直接复制偏移量即可
 	oldQueueLen := q.tempQueueLen()
 	for i := 0; i < oldQueueLen; i++ {
-		newVisitorRecord[i] = q.visitorRecord[q.head]
+		if q.resolution == 0 {
+			q.visitorRecord[i] = oldVisitorRecord[q.head]
+		} else {
+			q.offsets[i] = oldOffsets[q.head]
+		}
 		q.head = (q.head + 1) % q.maxSizeTemp
 	}
 	//新旧数据替换
-	q.visitorRecord = newVisitorRecord
 	q.maxSizeTemp = newVisitorRecordLen
 	q.head = 0
 	q.tail = oldQueueLen
 }
 
-//访问时间入对列,只用于从本地备份文件加载历史访问数据，本身是线性访问，无并发安全问题
+//访问时间入对列,只用于从本地备份文件加载历史访问数据
 func (q *autoGrowCircleQueueInt64) push(val int64) (err error) {
-	q.locker.Lock()
-	defer q.locker.Unlock()
 	if q.needGrow() {
 		q.grow()
 	}
 	if q.tempQueueIsFull() {
-		return errors.New("queue is full")
+		return errQueueFull
 	}
-	q.visitorRecord[q.tail] = val
+	q.set(q.tail, val)
 	q.tail = (q.tail + 1) % q.maxSizeTemp
 	return
 }
 
-//访问时间入对列,并发安全,由于不同协程在高并发的时候，极端情况下，也即前后两次访问的时间差，与两协程的系统切换时间非常接近的情况下
-//由调用者自己生成时间容易出现紊乱的情况，所以访问时间只能到这个地方来统一生成，也即有极小的概率，先访问的时间比后访问的时间大
+//访问时间入对列,由于不同协程在高并发的时候，极端情况下，也即前后两次访问的时间差，与两协程的系统切换时间非常接近的情况下
+//由调用者自己生成时间容易出现紊乱的情况，所以访问时间只能在持有锁后到这个地方来统一生成，也即有极小的概率，先访问的时间比后访问的时间大
 func (q *autoGrowCircleQueueInt64) pushWithConcurrencysafety(defaultExpiration time.Duration) (err error) {
-	q.locker.Lock()
-	defer q.locker.Unlock()
 	if q.needGrow() {
 		q.grow()
 	}
 	if q.tempQueueIsFull() {
-		return errors.New("queue is full")
+		return errQueueFull
 	}
-	q.visitorRecord[q.tail] = time.Now().Add(defaultExpiration).UnixNano()
+	q.set(q.tail, nowUnixNano()+int64(defaultExpiration))
 	q.tail = (q.tail + 1) % q.maxSizeTemp
 	return
 }
 
-//出对列
-func (q *autoGrowCircleQueueInt64) pop() (val int64, err error) {
-	q.locker.Lock()
-	defer q.locker.Unlock()
-	if q.tempQueueIsEmpty() {
-		return 0, errors.New("queue is empty")
-	}
-	val = q.visitorRecord[q.head]
-	q.head = (q.head + 1) % q.maxSizeTemp
-	return
+//清空队列中的所有访问记录
+func (q *autoGrowCircleQueueInt64) clear() {
+	q.head = q.tail
 }
 
-//用于备份数据的时候，虚拟队列的出队列操作，但实际未进行出队列操作
-func (q *autoGrowCircleQueueInt64) tempQueuePopForCopy() (val int64, err error) {
-	if q.tempQueueIsEmptyForCopy() {
-		return 0, errors.New("queue is empty")
+//用于备份数据的时候，按先后顺序复制队列中的所有访问记录，但实际未进行出队列操作
+func (q *autoGrowCircleQueueInt64) copyRecords() []int64 {
+	size := q.usedSize()
+	records := make([]int64, size)
+	index := q.head
+	for i := 0; i < size; i++ {
+		records[i] = q.at(index)
+		index = (index + 1) % q.maxSizeTemp
 	}
-	val = q.visitorRecord[q.headForCopy]
-	q.headForCopy = (q.headForCopy + 1) % q.maxSizeTemp
-	return
+	return records
 }
 
 //用于备份数据的时候，判断虚拟队列是否已满
@@ -152,11 +227,6 @@ func (q *autoGrowCircleQueueInt64) tempQueueIsEmpty() bool {
 	return q.tail == q.head
 }
 
-//用于备份数据的时候，判断虚拟队列是否为空
-func (q *autoGrowCircleQueueInt64) tempQueueIsEmptyForCopy() bool {
-	return q.tailForCopy == q.headForCopy
-}
-
 //判断队列已使用多少个元素
 func (q *autoGrowCircleQueueInt64) usedSize() int {
 	return (q.tail + q.maxSizeTemp - q.head) % q.maxSizeTemp
@@ -178,17 +248,15 @@ func (q *autoGrowCircleQueueInt64) tempQueueLen() int {
 }
 
 //删除过期数据
-func (q *autoGrowCircleQueueInt64) deleteExpired(key interface{}) {
-	q.locker.Lock()
-	defer q.locker.Unlock()
-	now := time.Now().UnixNano()
+func (q *autoGrowCircleQueueInt64) deleteExpired() {
+	now := nowUnixNano()
 	size := q.usedSize()
 	if size == 0 {
 		return
 	}
 	//依次删除过期数据
 	for i := 0; i < size; i++ {
-		if now > q.visitorRecord[q.head] {
+		if now > q.at(q.head) {
 			q.head = (q.head + 1) % q.maxSizeTemp
 		} else {
 			return
@@ -0,0 +1,76 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_queueCompactRecords(t *testing.T) {
+	compact := newAutoGrowCircleQueueInt64(3000, time.Millisecond)
+	plain := newAutoGrowCircleQueueInt64(3000, 0)
+	base := nowUnixNano() + int64(time.Hour)
+	//超过1023条时需要扩容,扩容后访问记录仍需保持原样
+	for i := 0; i < 3000; i++ {
+		val := base + int64(i)*int64(time.Microsecond*1500)
+		if err := compact.push(val); err != nil {
+			t.Fatal(err)
+		}
+		plain.push(val)
+	}
+	records, want := compact.copyRecords(), plain.copyRecords()
+	for i := range records {
+		//向上取整到毫秒,只会推迟过期
+		if records[i] < want[i] || records[i]-want[i] >= int64(time.Millisecond) {
+			t.Fatalf("record %d: expected %d rounded up to millisecond,got %d", i, want[i], records[i])
+		}
+	}
+	if compact.storageBytes()*2 != plain.storageBytes() {
+		t.Fatalf("expected half the storage,got %d and %d", compact.storageBytes(), plain.storageBytes())
+	}
+}
+
+func Test_queueRebase(t *testing.T) {
+	q := newAutoGrowCircleQueueInt64(10, time.Millisecond)
+	now := nowUnixNano()
+	q.push(now - int64(time.Hour)*24*30)
+	q.push(now + int64(time.Hour))
+	q.deleteExpired()
+	//与base相差超过uint32所能表示的毫秒数,需以最早的一条访问记录为新的base
+	far := now + int64(time.Hour)*24*30
+	q.push(far)
+	records := q.copyRecords()
+	if len(records) != 2 {
+		t.Fatalf("unexpected records after rebase: %v", records)
+	}
+	for i, want := range []int64{now + int64(time.Hour), far} {
+		if records[i] < want || records[i]-want >= int64(time.Millisecond) {
+			t.Fatalf("record %d: expected %d rounded up to millisecond,got %d", i, want, records[i])
+		}
+	}
+}
+
+func Test_ruleRecordResolution(t *testing.T) {
+	r := NewRule()
+	r.SetRecordResolution(time.Second)
+	r.AddRule(time.Minute, 10)
+	for i := 0; i < 3; i++ {
+		r.AllowVisit("ydg")
+	}
+	if remaining := r.RemainingVisit("ydg"); remaining != 7 {
+		t.Fatalf("expected 7 remaining visits,got %d", remaining)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for a rule too long for the resolution")
+		}
+	}()
+	r2 := NewRule()
+	r2.SetRecordResolution(time.Microsecond)
+	r2.AddRule(time.Hour*24, 100)
+}
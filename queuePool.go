@@ -0,0 +1,63 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"math/bits"
+	"sync"
+	"time"
+)
+
+/*
+回收的队列按存储方式(int64或uint32)及初始存储空间的大小分级缓存在sync.Pool中,所有Rule共用,
+新用户优先使用缓存的队列,不再为每条规则按预计在线用户数预先分配,空闲的Rule几乎不占内存,
+长时间没有新用户时缓存的队列由GC自动释放。
+队列初始存储空间的容量均为2的幂,最大为1024,收缩(见reSet)后也是如此,所以每一级中的队列容量相同
+*/
+var queuePools [2][11]sync.Pool
+
+//存储空间长度为n(不超过1024)的队列所属的级别,其容量为1<<queueClass(n)
+func queueClass(n int) int {
+	return bits.Len(uint(n - 1))
+}
+
+//存储方式对应的缓存
+func queuePoolsOf(resolution time.Duration) *[11]sync.Pool {
+	if resolution == 0 {
+		return &queuePools[0]
+	}
+	return &queuePools[1]
+}
+
+//取一个空闲的队列,没有缓存时新建
+func getQueue(size int, resolution time.Duration) *autoGrowCircleQueueInt64 {
+	n := min(size+1, 1024)
+	v := queuePoolsOf(resolution)[queueClass(n)].Get()
+	if v == nil {
+		return newAutoGrowCircleQueueInt64(size, resolution)
+	}
+	//不改变key,gen及locker,仍持有该队列的过期检查记录等会因key或gen不符而放弃
+	q := v.(*autoGrowCircleQueueInt64)
+	q.maxSize = size + 1
+	q.maxSizeTemp = n
+	q.visitorRecord = q.visitorRecord[:min(n, cap(q.visitorRecord))]
+	q.offsets = q.offsets[:min(n, cap(q.offsets))]
+	q.base = 0
+	q.resolution = int64(resolution)
+	q.head = 0
+	q.tail = 0
+	return q
+}
+
+//缓存已回收的队列,调用者需已释放队列的锁且队列已不属于任何用户
+func putQueue(q *autoGrowCircleQueueInt64) {
+	c := cap(q.visitorRecord) + cap(q.offsets)
+	if c > 1024 || c&(c-1) != 0 {
+		return
+	}
+	queuePoolsOf(time.Duration(q.resolution))[queueClass(c)].Put(q)
+}
@@ -0,0 +1,51 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_queuePoolLazy(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Minute, 100, 100000)
+	r.AddRule(time.Hour, 1000, 100000)
+	if stats := r.KeyStatistics(); stats.Bytes != 0 {
+		t.Fatalf("expected an idle rule to hold no queues,got %+v", stats)
+	}
+	r.AllowVisit("ydg")
+	if stats := r.KeyStatistics(); stats.Keys != 2 {
+		t.Fatalf("expected one queue per rule,got %+v", stats)
+	}
+}
+
+func Test_queuePoolOwner(t *testing.T) {
+	a := createsingleRule(new(keyLimit), nil, 0, time.Minute, time.Second, 10, 0)
+	b := createsingleRule(new(keyLimit), nil, 0, time.Hour, time.Second, 10, 0)
+	a.add("ydg")
+	q := a.lookup("ydg")
+	a.manualEmptyVisitorRecordsOf("ydg")
+	//同一用户在其它规则中可能重新使用该队列,原规则不能再使用
+	b.add("ydg")
+	if q.lockFor(a, "ydg") {
+		t.Fatal("expected the recycled queue to be unusable by its former rule")
+	}
+	if b.lookup("ydg") == q {
+		if !q.lockFor(b, "ydg") {
+			t.Fatal("expected the reused queue to belong to its new rule")
+		}
+		q.locker.Unlock()
+	}
+	a.add("ydg")
+	if remaining := a.remainingVisits("ydg"); remaining != 9 {
+		t.Fatalf("expected 9 remaining visits,got %d", remaining)
+	}
+	if remaining := b.remainingVisits("ydg"); remaining != 9 {
+		t.Fatalf("expected 9 remaining visits,got %d", remaining)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+历史备份的保留策略,开启后每次存盘成功都会在备份文件名加.ratelimit_history的目录下保留一份历史备份,
+文件名为存盘时间(UTC),之后按以下规则清理多余的历史备份,三条规则保留的历史备份取并集,例:
+Retention{KeepLast: 10, Hourly: 24, Daily: 7}
+表示保留最近10次存盘,以及最近24个小时每小时最后一次存盘,以及最近7天每天最后一次存盘
+*/
+type Retention struct {
+	KeepLast int //保留最近的N个历史备份
+	Hourly   int //保留最近N个小时中,每小时的最后一个历史备份
+	Daily    int //保留最近N天中,每天(UTC)的最后一个历史备份
+}
+
+//历史备份文件名中的时间格式,按字符串排序即为按时间排序
+const generationTimeLayout = "20060102T150405.000000000Z"
+
+func (rt Retention) enabled() bool {
+	return rt.KeepLast > 0 || rt.Hourly > 0 || rt.Daily > 0
+}
+
+//返回需要保留的历史备份,generations需从早到晚排列
+func (rt Retention) keep(generations []time.Time) map[time.Time]bool {
+	keep := make(map[time.Time]bool)
+	hours := make(map[time.Time]bool)
+	days := make(map[string]bool)
+	for i := len(generations) - 1; i >= 0; i-- {
+		t := generations[i].UTC()
+		if len(generations)-i <= rt.KeepLast {
+			keep[generations[i]] = true
+		}
+		if hour := t.Truncate(time.Hour); !hours[hour] && len(hours) < rt.Hourly {
+			hours[hour] = true
+			keep[generations[i]] = true
+		}
+		if day := t.Format("2006-01-02"); !days[day] && len(days) < rt.Daily {
+			days[day] = true
+			keep[generations[i]] = true
+		}
+	}
+	return keep
+}
+
+//历史备份所在目录
+func (r *Rule) generationDir() string {
+	return r.backupFileName + ".ratelimit_history"
+}
+
+func (r *Rule) generationFileName(t time.Time) string {
+	return filepath.Join(r.generationDir(), t.UTC().Format(generationTimeLayout)+".ratelimit")
+}
+
+//把刚刚完成的备份加入历史备份,并清理多余的历史备份,调用者需持有lockerForBackup
+func (r *Rule) keepGeneration(t time.Time) error {
+	if err := os.MkdirAll(r.generationDir(), 0755); err != nil {
+		return err
+	}
+	//优先使用硬链接,正式备份文件之后被替换时,硬链接指向的仍是本次备份的内容;不支持硬链接时复制一份
+	src, dst := r.backupFileName+".ratelimit", r.generationFileName(t)
+	if err := os.Link(src, dst); err != nil {
+		if err = copyFile(dst, src); err != nil {
+			return err
+		}
+	}
+	generations, err := r.generations()
+	if err != nil {
+		return err
+	}
+	keep := r.saveOptions.Retention.keep(generations)
+	for _, g := range generations {
+		if !keep[g] {
+			if err = os.Remove(r.generationFileName(g)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//列出所有历史备份的存盘时间,从早到晚排列,可用于LoadGeneration
+func (r *Rule) Generations() ([]time.Time, error) {
+	if !r.needBackup {
+		panic("If you want't to use Generations,you should use LoadingAndAutoSaveToDisc after AddRule.")
+	}
+	r.lockerForBackup.Lock()
+	defer r.lockerForBackup.Unlock()
+	return r.generations()
+}
+
+func (r *Rule) generations() ([]time.Time, error) {
+	entries, err := os.ReadDir(r.generationDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var generations []time.Time
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".ratelimit")
+		if t, err := time.Parse(generationTimeLayout, name); err == nil && !entry.IsDir() {
+			generations = append(generations, t)
+		}
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i].Before(generations[j]) })
+	return generations, nil
+}
+
+/*
+把某个历史备份加载到一个只读的新Rule中,用于事后调查,例:
+generations, _ := r.Generations()
+old, err := r.LoadGeneration(generations[0])
+old.GetCurOnlineUsersVisitsDetail()
+新Rule的规则与当前Rule相同,加载的是存盘时未过期的访问记录,之后不会定期清除过期数据,
+可以调用ExportJSONLines,GetCurOnlineUsersVisitsDetail等函数查看,但不能调用AllowVisit等会修改访问记录的函数
+*/
+func (r *Rule) LoadGeneration(t time.Time) (*Rule, error) {
+	if !r.needBackup {
+		panic("If you want't to use LoadGeneration,you should use LoadingAndAutoSaveToDisc after AddRule.")
+	}
+	f, err := os.Open(r.generationFileName(t))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := readSnapshot(f)
+	if err != nil {
+		return nil, err
+	}
+	//只读的Rule不需要定期清除过期数据
+	g := &Rule{readOnly: true}
+	for _, rule := range r.rules {
+		g.rules = append(g.rules, createsingleRule(new(keyLimit), nil, rule.resolution, rule.defaultExpiration, rule.cleanupInterval, rule.numberOfAllowedAccesses, 0))
+	}
+	//以存盘时间为准,存盘时未过期的访问记录均加载
+	g.lastLoad, err = g.restore(s, t)
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+//复制文件
+func copyFile(dstFileName, srcFileName string) error {
+	src, err := os.Open(srcFileName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(dstFileName)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_retentionKeep(t *testing.T) {
+	base := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	var generations []time.Time
+	//两天内每半小时一次存盘
+	for i := 0; i < 96; i++ {
+		generations = append(generations, base.Add(time.Duration(i)*time.Minute*30))
+	}
+	keep := Retention{KeepLast: 3, Hourly: 4, Daily: 2}.keep(generations)
+	//最近3次,另加最近4个小时各自的最后一次(其中2个与最近3次重合),第一天的最后一次
+	if len(keep) != 6 {
+		t.Fatalf("unexpected kept generations: %v", keep)
+	}
+	if !keep[generations[47]] || !keep[generations[95]] || keep[generations[0]] {
+		t.Fatalf("unexpected kept generations: %v", keep)
+	}
+}
+
+func Test_loadGeneration(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Minute, 10)
+	r.SetSaveOptions(SaveOptions{Directory: t.TempDir(), Retention: Retention{KeepLast: 2}})
+	r.LoadingAndAutoSaveToDisc("retention", time.Hour)
+	defer r.releaseBackupFile()
+	for i := 0; i < 3; i++ {
+		r.AllowVisit("ydg")
+		if err := r.SaveToDiscOnce(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	generations, err := r.Generations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generations) != 2 {
+		t.Fatalf("expected 2 generations,got %v", generations)
+	}
+	old, err := r.LoadGeneration(generations[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining := old.RemainingVisit("ydg"); remaining != 8 {
+		t.Fatalf("expected 8 remaining visits in the older generation,got %d", remaining)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected AllowVisit on a read-only rule to panic")
+		}
+	}()
+	old.AllowVisit("ydg")
+}
+
+//存盘期间仍有访问,每个历史备份都可以加载
+func Test_loadGenerationDuringVisits(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Minute, 1000)
+	r.SetSaveOptions(SaveOptions{Directory: t.TempDir(), Retention: Retention{KeepLast: 5}})
+	r.LoadingAndAutoSaveToDisc("retention", time.Hour)
+	defer r.releaseBackupFile()
+	//足够多的用户使每次存盘都需要一段时间
+	for i := 0; i < 20000; i++ {
+		r.AllowVisit(i)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+					r.AllowVisit(i % 20000)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		if err := r.SaveToDiscOnce(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	generations, err := r.Generations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generations) != 5 {
+		t.Fatalf("expected 5 generations,got %v", generations)
+	}
+	for _, generation := range generations {
+		if _, err := r.LoadGeneration(generation); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -6,10 +6,13 @@
 package ratelimit
 
 import (
+	"hash/maphash"
 	"math"
+	"os"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,9 +22,28 @@ type Rule struct {
 	//以下用于备份数据，在需要备份时才在作用
 	needBackup         bool          //是否需要把数据备份到硬盘，开启备份之后，不允许再临时增加规则singleRule
 	backupFileName     string        //缓存存到硬盘上的文件名
+	backupFileLock     *os.File      //备份文件的锁,防止多个进程同时使用同一备份文件
 	backUpInterval     time.Duration //默认多长时间需要执行一次数据备份操作
-	lockerForBackup    *sync.Mutex   //用于数据备份
+	finished           atomic.Bool   //上一轮次的存盘是否已完成,定期存盘与信号触发的存盘共用
+	stopAutoSave       chan struct{} //关闭后停止定期存盘
+	stopAutoSaveOnce   sync.Once
+	saveOptions        SaveOptions //数据备份选项
+	lastSave           BackupStatistics
+	lastLoad           BackupStatistics
+	lockerForBackup    sync.Mutex //用于数据备份
 	loadBackupFileOnce sync.Once
+	readOnly           bool           //由LoadGeneration加载的历史备份,只能查看,不能再访问或修改
+	inStore            bool           //已加入Store,由Store统一存盘
+	limit              *keyLimit      //用户数及内存限制,见SetKeyLimit
+	recordResolution   time.Duration  //访问记录的精度,见SetRecordResolution
+	sketches           []*sketchRule  //近似规则,见AddApproximateRule
+	name               string         //规则名称,用于区分监控指标,见SetName
+	observers          observerList   //事件的观察者,见AddObserver
+	saveMetric         durationMetric //存盘的耗时及失败次数
+	loadMetric         durationMetric //加载备份数据的耗时及失败次数
+	allowed            atomic.Uint64  //被允许的访问次数,见metrics.go
+	denied             atomic.Uint64  //被拒绝的访问次数
+	closed             atomic.Bool    //已调用Close
 }
 
 /*
@@ -49,11 +71,15 @@ estimatedNumberOfOnlineUserNum 表示预计可能有多少人访问,此参数为
 以上任何一条用户访问控制策略没通过,都不允许访问，注意单条规则中，不宜设定监控时间段过大的规则，比如设定监控某个用户一个月甚至是1年的访问规则，它会占用大多的内存
 */
 func (r *Rule) AddRule(defaultExpiration time.Duration, numberOfAllowedAccesses int, estimatedNumberOfOnlineUserNum ...int) {
+	r.mustBeWritable()
 	//开启备份之后，不下允许添加规则
-	if r.needBackup {
-		panic("cant't use AddRule after LoadingAndAutoSaveToDisc")
+	if r.needBackup || r.inStore {
+		panic("cant't use AddRule after LoadingAndAutoSaveToDisc or Store.Add")
+	}
+	if r.recordResolution > 0 && defaultExpiration/r.recordResolution >= math.MaxUint32 {
+		panic("the rule's duration " + defaultExpiration.String() + " is too long for record resolution " + r.recordResolution.String())
 	}
-	r.rules = append(r.rules, newsingleRule(defaultExpiration, numberOfAllowedAccesses, estimatedNumberOfOnlineUserNum...))
+	r.rules = append(r.rules, newsingleRule(r.keyLimiter(), &r.observers, r.recordResolution, defaultExpiration, numberOfAllowedAccesses, estimatedNumberOfOnlineUserNum...))
 	//把时间控制调整为从小到大排列，防止用户在实例化的时候，未按照预期的时间顺序添加，导致某些规则失效
 	sort.Slice(r.rules, func(i int, j int) bool {
 		return r.rules[i].defaultExpiration < r.rules[j].defaultExpiration
@@ -80,19 +106,102 @@ func (r *Rule) AddRule(defaultExpiration time.Duration, numberOfAllowedAccesses
 AllowVisit("username")
 */
 func (r *Rule) AllowVisit(key interface{}) bool {
-	if len(r.rules) == 0 {
+	if len(r.rules) == 0 && len(r.sketches) == 0 {
 		panic("rule is empty，please add rule by AddRule")
 	}
+	r.mustBeWritable()
+	decision, allowed := r.visit(key)
+	if observers := r.observers.load(); len(observers) > 0 {
+		notifyVisit(observers, key, decision, allowed)
+	}
+	return r.counted(allowed)
+}
+
+//在各规则中增加一条访问记录,不允许访问时返回拒绝访问的规则及原因
+func (r *Rule) visit(key interface{}) (Decision, bool) {
 	//这个地方需要注意，如果前面的某些策略通过，但是后面的策略不通过。这时候，在前面允许访问的策略中，
 	//允许访问次数是会减少的,我们这里并没有严格的做回滚操作。
 	//原因在于一方面是性能，另外一方面是随着
 	//时间流逝，前面的策略中允许访问的次数很快就会自动增长。
 	for i := range r.rules {
-		if !r.rules[i].allowVisit(key) {
-			return false
+		if err := r.rules[i].add(key); err != nil {
+			return r.rules[i].decision(err), false
+		}
+	}
+	if len(r.sketches) > 0 {
+		return r.visitApproximately(keyHash(key))
+	}
+	return Decision{}, true
+}
+
+//近似规则是否允许访问,h为key的哈希值
+func (r *Rule) visitApproximately(h uint64) (Decision, bool) {
+	for i := range r.sketches {
+		if !r.sketches[i].allowVisit(h) {
+			return r.sketches[i].decision(), false
+		}
+	}
+	return Decision{}, true
+}
+
+/*
+与AllowVisit相同,用户名为string时使用,已访问过的用户不需要把key装箱为interface{},不分配内存,例:
+AllowVisitString("username")
+*/
+func (r *Rule) AllowVisitString(key string) bool {
+	if len(r.rules) == 0 && len(r.sketches) == 0 {
+		panic("rule is empty，please add rule by AddRule")
+	}
+	r.mustBeWritable()
+	decision, allowed := r.visitString(key)
+	//没有观察者时不装箱key
+	if observers := r.observers.load(); len(observers) > 0 {
+		notifyVisit(observers, key, decision, allowed)
+	}
+	return r.counted(allowed)
+}
+
+//与visit相同
+func (r *Rule) visitString(key string) (Decision, bool) {
+	for i := range r.rules {
+		if err := r.rules[i].addString(key); err != nil {
+			return r.rules[i].decision(err), false
 		}
 	}
-	return true
+	if len(r.sketches) > 0 {
+		return r.visitApproximately(maphash.String(keyIndexSeed, key))
+	}
+	return Decision{}, true
+}
+
+/*
+与AllowVisit(uint64(key))相同,以用户ID等整数作为用户名时使用,已访问过的用户不分配内存,例:
+AllowVisitUint64(10086)
+注意uint64(1)与int64(1)等其它整数类型是不同的用户
+*/
+func (r *Rule) AllowVisitUint64(key uint64) bool {
+	if len(r.rules) == 0 && len(r.sketches) == 0 {
+		panic("rule is empty，please add rule by AddRule")
+	}
+	r.mustBeWritable()
+	decision, allowed := r.visitUint64(key)
+	if observers := r.observers.load(); len(observers) > 0 {
+		notifyVisit(observers, key, decision, allowed)
+	}
+	return r.counted(allowed)
+}
+
+//与visit相同
+func (r *Rule) visitUint64(key uint64) (Decision, bool) {
+	for i := range r.rules {
+		if err := r.rules[i].addUint64(key); err != nil {
+			return r.rules[i].decision(err), false
+		}
+	}
+	if len(r.sketches) > 0 {
+		return r.visitApproximately(mixUint64(key))
+	}
+	return Decision{}, true
 }
 
 /*
@@ -117,6 +226,7 @@ func (r *Rule) ManualEmptyVisitorRecordsOf(key interface{}) {
 	if len(r.rules) == 0 {
 		panic("rule is empty，please add rule by AddRule")
 	}
+	r.mustBeWritable()
 	for i := range r.rules {
 		r.rules[i].manualEmptyVisitorRecordsOf(key)
 	}
@@ -124,10 +234,64 @@ func (r *Rule) ManualEmptyVisitorRecordsOf(key interface{}) {
 
 // 人工清空所有用户的访问数据
 func (r *Rule) ManualEmptyVisitorRecordsOfAll() {
+	r.mustBeWritable()
 	for i := range r.rules {
-		r.rules[i].usedVisitorRecordsIndex.Range(func(k, v interface{}) bool {
+		r.rules[i].rangeKeys(func(k interface{}, q *autoGrowCircleQueueInt64) bool {
 			r.rules[i].manualEmptyVisitorRecordsOf(k)
 			return true
 		})
 	}
 }
+
+/*
+设置访问记录的精度,需在AddRule之前调用,例:
+r.SetRecordResolution(time.Millisecond)
+默认每条访问记录以int64保存纳秒时间,严格按滑动窗口计算,访问记录恰好在计时周期后过期。
+设置精度后改为以相对于队列中最早访问记录的uint32偏移量保存,内存占用减半,但滑动窗口的语义随之改变:
+访问记录的过期时间向上取整到该精度,即最多推迟一个精度单位过期,不会提前过期,
+所以达到上限的用户最多要在计时周期之后再多等一个精度单位才能再次访问,例如精度为秒时最多多等1秒。
+不设置精度(或设置为0)时保持精确的滑动窗口。
+uint32所能表示的时间范围有限,精度为毫秒时计时周期不能超过约49天,精度为秒时约136年,超出时AddRule将panic
+*/
+func (r *Rule) SetRecordResolution(resolution time.Duration) {
+	r.mustBeWritable()
+	if len(r.rules) > 0 {
+		panic("SetRecordResolution must be called before AddRule")
+	}
+	if resolution < 0 {
+		panic("record resolution can't be negative")
+	}
+	r.recordResolution = resolution
+}
+
+/*
+关闭Rule,停止各条规则清除过期数据的协程,开启了LoadingAndAutoSaveToDisc时还会停止定期存盘,做最后一次存盘并释放备份文件的锁,
+一般在程序退出前,或者为每个租户单独创建的Rule不再使用时调用,例:
+defer r.Close()
+关闭后不应再调用AllowVisit等函数,重复调用时直接返回nil。加入Store的Rule由Store.Close存盘,Close只停止清除过期数据
+*/
+func (r *Rule) Close() error {
+	if !r.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	var err error
+	if r.needBackup {
+		r.stopAutoSaveOnce.Do(func() { close(r.stopAutoSave) })
+		//SaveOnSignal已做过最后一次存盘并释放了备份文件的锁
+		if err = r.saveExclusively(); err == errBackupFileReleased {
+			err = nil
+		}
+		r.releaseBackupFile()
+	}
+	for _, s := range r.rules {
+		s.stop()
+	}
+	return err
+}
+
+//由LoadGeneration加载的历史备份只能查看,不允许再访问或修改
+func (r *Rule) mustBeWritable() {
+	if r.readOnly {
+		panic("this rule is read-only,it is loaded by LoadGeneration for inspection only")
+	}
+}
@@ -7,26 +7,42 @@
 package ratelimit
 
 import (
-	"bufio"
-	"bytes"
 	"encoding/binary"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 )
 
-//如果有历史备份文件，则加载，无历史备份文件则后续自动生成，并且开启自动保存，默认60秒完成一次存盘
+//备份文件已被其它进程锁定,内容为持有锁的进程号,未知时为空
+type lockedError string
+
+func (e lockedError) Error() string {
+	if e == "" {
+		return "it is locked by another process"
+	}
+	return "it is locked by another process:" + string(e)
+}
+
+/*
+如果有历史备份文件，则加载，无历史备份文件则后续自动生成，并且开启自动保存，默认60秒完成一次存盘
+备份文件在使用期间会加排它锁(锁文件为备份文件名加.lock)，同一备份文件已被其它进程或者其它Rule使用时直接panic，
+以免多个进程相互覆盖对方的备份数据。若需把备份文件放到指定目录，需在此之前通过SetSaveOptions设置Directory
+*/
 func (r *Rule) LoadingAndAutoSaveToDisc(backupFileName string, backUpInterval ...time.Duration) {
+	r.mustBeWritable()
 	r.loadBackupFileOnce.Do(func() {
-		r.lockerForBackup = new(sync.Mutex)
 		if len(r.rules) == 0 {
 			panic("rule is empty，please add rule by AddRule")
 		}
+		if r.inStore {
+			panic("this rule is backed up by Store,please use Store.LoadingAndAutoSaveToDisc instead")
+		}
 		r.needBackup = true
-		r.backupFileName = strings.Split(backupFileName, ".")[0]
+		r.finished.Store(true)
+		//只去掉文件名的扩展名,目录名中的"."需保留,如/var/lib/app.d/limits
+		r.backupFileName = strings.TrimSuffix(backupFileName, filepath.Ext(backupFileName))
 		if len(backUpInterval) == 0 {
 			//默认60秒存盘一次
 			r.backUpInterval = time.Second * 60
@@ -36,172 +52,158 @@ func (r *Rule) LoadingAndAutoSaveToDisc(backupFileName string, backUpInterval ..
 		if r.backupFileName == "" {
 			panic("backupFileName err:" + backupFileName)
 		}
+		r.lockerForBackup.Lock()
+		if r.saveOptions.Directory != "" && !filepath.IsAbs(r.backupFileName) {
+			r.backupFileName = filepath.Join(r.saveOptions.Directory, r.backupFileName)
+		}
+		r.lockerForBackup.Unlock()
+		//备份文件所在目录不存在时，先创建目录，再对备份文件加锁
+		err := os.MkdirAll(filepath.Dir(r.backupFileName), 0755)
+		if err != nil {
+			panic(err)
+		}
+		r.backupFileLock, err = lockFile(r.backupFileName + ".ratelimit.lock")
+		if err != nil {
+			panic(`can't lock the backup file:"` + r.backupFileName + `.ratelimit",` + err.Error())
+		}
 		//初次运行程序时，无备份文件，不认为是错误
-		err := r.loading()
+		err = r.loading()
 		if err != nil {
 			if !strings.HasPrefix(err.Error(), "Open backup file fail") {
 				panic(err.Error() + ` please repair or remove the backup file:"` + r.backupFileName + `.ratelimit" and then restart this program.`)
 			}
 		}
-		go func() {
-			finished := true
-			for range time.Tick(r.backUpInterval) {
-				//如果数据量较大，那么在一个时间周期内不一定会完成存盘操作,所以要判断上一轮次的存盘是否完成
-				if finished {
-					finished = false
-					err = r.SaveToDiscOnce()
-					finished = true
-				}
-			}
-		}()
+		r.stopAutoSave = make(chan struct{})
+		go r.autoSave()
 	})
 }
 
-//把数据保存到硬盘上,仅支持key为string,int,int64等类型数据的缓存
-func (r *Rule) SaveToDiscOnce() (err error) {
+//定期自动存盘,直到stopAutoSave被关闭
+func (r *Rule) autoSave() {
+	ticker := time.NewTicker(r.backUpInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			//如果数据量较大，那么在一个时间周期内不一定会完成存盘操作,所以要判断上一轮次的存盘是否完成
+			//由信号触发的存盘同样会设置finished,两者不会同时进行
+			if r.finished.CompareAndSwap(true, false) {
+				r.SaveToDiscOnce()
+				r.finished.Store(true)
+			}
+		case <-r.stopAutoSave:
+			return
+		}
+	}
+}
+
+//设置数据备份选项,例:
+//r.SetSaveOptions(ratelimit.SaveOptions{Format: ratelimit.BackupFormatCompact, Compression: ratelimit.CompressionGzip})
+//用户数量较多时,建议使用紧凑格式并开启压缩,备份文件的大小一般可减少至原始格式的五分之一以下
+func (r *Rule) SetSaveOptions(opts SaveOptions) {
 	r.lockerForBackup.Lock()
 	defer r.lockerForBackup.Unlock()
+	r.saveOptions = opts
+}
+
+//把数据保存到硬盘上,支持key为string,int,int64等类型数据的缓存,其它类型的key需先通过RegisterKeyCodec注册编解码器,
+//否则返回错误
+func (r *Rule) SaveToDiscOnce() (err error) {
 	if len(r.rules) == 0 {
 		panic("rule is empty，please add rule by AddRule")
 	}
 	if !r.needBackup {
 		panic("If you want't to SaveToDiscOnce,you should use LoadingAndAutoSaveToDisc after AddRule.")
 	}
-	f, err := os.Create(r.backupFileName + ".ratelimit_temp")
+	var stats BackupStatistics
+	//先于解锁注册,解锁之后才通知观察者
+	defer func(start time.Time) {
+		r.saveMetric.observe(start, err)
+		r.notifySave(stats, err)
+	}(time.Now())
+	r.lockerForBackup.Lock()
+	defer r.lockerForBackup.Unlock()
+	//备份文件的锁已释放,其它进程可能正在使用该备份文件
+	if r.backupFileLock == nil {
+		return errBackupFileReleased
+	}
+	//临时文件名中带有随机数，即使有多个进程同时存盘，也不会写入同一个临时文件
+	f, err := os.CreateTemp(filepath.Dir(r.backupFileName), filepath.Base(r.backupFileName)+".ratelimit_temp*")
 	if err != nil {
 		return err
 	}
-	defer os.Remove(r.backupFileName + ".ratelimit_temp")
-	buf := bufio.NewWriterSize(f, 40960)
-	//1 先写规则数量
-	_, err = buf.Write(uint64ToByte(uint64(len(r.rules))))
+	defer os.Remove(f.Name())
+	stats, err = r.saveTo(f)
 	if err != nil {
+		f.Close()
 		return err
 	}
-	//2 依次写入每一组数据
-	for i := range r.rules {
-		curRuleData := new(bytes.Buffer)
-		tempBuf := bufio.NewWriterSize(curRuleData, 40960)
-		curRuleKeyNum := 0
-		r.rules[i].usedVisitorRecordsIndex.Range(func(key, Index interface{}) bool {
-			index := Index.(int)
-			//备份过程中，不允许其它操作，加锁
-			r.rules[i].visitorRecords[index].locker.Lock()
-			//有效的才能加进去
-			//2.3.1 写入key，key指用户名IP等，只能是数字或string
-			switch key.(type) {
-			case string:
-				//与其它类型不同，KEY长度是不定长的
-				tempBuf.Write([]byte{0x00})
-				tempBuf.Write(uint64ToByte(uint64(len(key.(string)))))
-				tempBuf.WriteString(key.(string))
-			case int:
-				tempBuf.Write([]byte{0x01})
-				tempBuf.Write(uint64ToByte(uint64(key.(int))))
-			case int8:
-				tempBuf.Write([]byte{0x02})
-				tempBuf.Write(uint64ToByte(uint64(key.(int8))))
-			case int16:
-				tempBuf.Write([]byte{0x03})
-				tempBuf.Write(uint64ToByte(uint64(key.(int16))))
-			case int32:
-				tempBuf.Write([]byte{0x04})
-				tempBuf.Write(uint64ToByte(uint64(key.(int32))))
-			case int64:
-				tempBuf.Write([]byte{0x05})
-				tempBuf.Write(uint64ToByte(uint64(key.(int64))))
-			case uint:
-				tempBuf.Write([]byte{0x06})
-				tempBuf.Write(uint64ToByte(uint64(key.(uint))))
-			case uint8:
-				tempBuf.Write([]byte{0x07})
-				tempBuf.Write(uint64ToByte(uint64(key.(uint8))))
-			case uint16:
-				tempBuf.Write([]byte{0x08})
-				tempBuf.Write(uint64ToByte(uint64(key.(uint16))))
-			case uint32:
-				tempBuf.Write([]byte{0x09})
-				tempBuf.Write(uint64ToByte(uint64(key.(uint32))))
-			case uint64:
-				tempBuf.Write([]byte{0x0A})
-				tempBuf.Write(uint64ToByte(key.(uint64)))
-			default:
-				panic("key type can only be string,int,int8,int16,int32,int64,uint,uint8,uint16,uint32,uint64")
-			}
-			r.rules[i].visitorRecords[index].tailForCopy = r.rules[i].visitorRecords[index].tail
-			r.rules[i].visitorRecords[index].headForCopy = r.rules[i].visitorRecords[index].head
-			size := r.rules[i].visitorRecords[index].usedSize()
-			//2.3.2写下当前key对应的有效访问记录数,为了简单，不判断其是否过期
-			tempBuf.Write(uint64ToByte(uint64(size)))
-			if size > 0 {
-				for ii := 0; ii < size; ii++ {
-					val, _ := r.rules[i].visitorRecords[index].tempQueuePopForCopy()
-					//2.3.3写下每条访问数据的时间点
-					tempBuf.Write(uint64ToByte(uint64(val)))
-				}
-			}
-			curRuleKeyNum++
-			r.rules[i].visitorRecords[index].locker.Unlock()
-			return true
-		})
-		//2.1 //先写当前下标
-		buf.Write(uint64ToByte(uint64(i)))
-		//2.2 再写当前键的个数
-		buf.Write(uint64ToByte(uint64(curRuleKeyNum)))
-		//2.3再写某个键下面的所有数据，如果无数据，则不写
-		//tempBuf由上面提前算出
-		if curRuleKeyNum > 0 {
-			tempBuf.Flush()
-			b := curRuleData.Bytes()
-			buf.Write(b)
-		}
-	}
-	buf.Flush()
 	err = f.Close()
 	if err != nil {
 		return
 	}
-	//成功生成临时文件后，成替换正式文件
-	_, err = copyFile(r.backupFileName+".ratelimit", r.backupFileName+".ratelimit_temp")
+	//成功生成临时文件后，用重命名的方式替换正式文件，替换过程中程序中断也不会留下不完整的备份文件
+	err = os.Rename(f.Name(), r.backupFileName+".ratelimit")
+	if err != nil {
+		return
+	}
+	r.lastSave = stats
+	//需要保留历史备份时，把本次备份加入历史备份，并清理多余的历史备份
+	if r.saveOptions.Retention.enabled() {
+		err = r.keepGeneration(stats.Time)
+	}
 	return
 }
+
+/*
+把数据按SetSaveOptions设置的格式写入w,不依赖LoadingAndAutoSaveToDisc,可用于通过管道传输备份数据,
+或者把备份数据放入自己的备份文件中,例:
+var buf bytes.Buffer
+err := r.SaveTo(&buf)
+*/
+func (r *Rule) SaveTo(w io.Writer) error {
+	if len(r.rules) == 0 {
+		panic("rule is empty，please add rule by AddRule")
+	}
+	start := time.Now()
+	r.lockerForBackup.Lock()
+	stats, err := r.saveTo(w)
+	if err == nil {
+		r.lastSave = stats
+	}
+	r.lockerForBackup.Unlock()
+	r.saveMetric.observe(start, err)
+	r.notifySave(stats, err)
+	return err
+}
+
+//依次写入每一组数据,每次只复制一条规则的访问记录,复制时只短暂持有各队列的锁,调用者需持有lockerForBackup
+func (r *Rule) saveTo(w io.Writer) (BackupStatistics, error) {
+	var stats BackupStatistics
+	err := writeSnapshot(w, r.saveOptions, len(r.rules), func(i int) *snapshotRule {
+		return r.rules[i].snapshot(i, &stats)
+	})
+	//存盘时间取复制完所有规则之后的时间,存盘期间新增的访问记录也不会晚于存盘时间,LoadGeneration以此时间加载时不会被判定为非法
+	stats.Time = clockNow()
+	return stats, err
+}
+
+//最近一次成功存盘的统计数据
+func (r *Rule) LastSaveStatistics() BackupStatistics {
+	r.lockerForBackup.Lock()
+	defer r.lockerForBackup.Unlock()
+	return r.lastSave
+}
+
+//最近一次成功加载备份数据的统计数据
+func (r *Rule) LastLoadStatistics() BackupStatistics {
+	r.lockerForBackup.Lock()
+	defer r.lockerForBackup.Unlock()
+	return r.lastLoad
+}
+
 func uint64ToByte(i uint64) []byte {
 	b := make([]byte, 8)
 	binary.LittleEndian.PutUint64(b, i)
 	return b
 }
-
-//复制文件，目标文件所在目录不存在，则创建目录后再复制
-//Copy(`d:\test\hello.txt`,`c:\test\hello.txt`)
-func copyFile(dstFileName, srcFileName string) (w int64, err error) {
-	//打开源文件
-	srcFile, err := os.Open(srcFileName)
-	if err != nil {
-		return 0, err
-	}
-	defer srcFile.Close()
-	// 创建新的文件作为目标文件
-	dstFile, err := os.Create(dstFileName)
-	if err != nil {
-		//如果出错，很可能是目标目录不存在，需要先创建目标目录
-		err = os.MkdirAll(filepath.Dir(dstFileName), 0666)
-		if err != nil {
-			return 0, err
-		}
-		//再次尝试创建
-		dstFile, err = os.Create(dstFileName)
-		if err != nil {
-			return 0, err
-		}
-	}
-	defer dstFile.Close()
-	//通过bufio实现对大文件复制的自动支持
-	dst := bufio.NewWriter(dstFile)
-	defer dst.Flush()
-	src := bufio.NewReader(srcFile)
-	w, err = io.Copy(dst, src)
-	if err != nil {
-		return 0, err
-	}
-	return w, err
-}
@@ -0,0 +1,37 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//目录名中带有"."时,只去掉文件名的扩展名
+func Test_saveDottedDir(t *testing.T) {
+	backupFileName := filepath.Join(t.TempDir(), "dir.v1", "name")
+	r := NewRule()
+	r.AddRule(time.Minute, 10)
+	r.LoadingAndAutoSaveToDisc(backupFileName, time.Hour)
+	r.AllowVisit("ydg")
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(backupFileName + ".ratelimit"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewRule()
+	loaded.AddRule(time.Minute, 10)
+	loaded.LoadingAndAutoSaveToDisc(backupFileName+".ratelimit", time.Hour)
+	defer loaded.Close()
+	if remaining := loaded.RemainingVisits("ydg")[0]; remaining != 9 {
+		t.Fatalf("expected 9 remaining visits,got %d", remaining)
+	}
+}
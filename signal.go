@@ -0,0 +1,92 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+//收到后做最后一次存盘的信号
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+/*
+开启信号存盘,需在LoadingAndAutoSaveToDisc之后调用,例:
+done := r.SaveOnSignal(func(sig os.Signal, err error) {
+	log.Println("saved on", sig, err)
+})
+收到SIGTERM或SIGINT(Ctrl+C)时，停止定期存盘并做最后一次存盘，之后释放备份文件的锁，关闭返回的done，停止监听这两个信号，
+再把收到的信号重新发送给本进程。程序自己没有处理该信号时按默认方式处理，即存盘完成后程序退出；
+程序自己也监听了该信号时，会在done关闭后再收到一次该信号，退出前需等待done关闭，以免最后一次存盘未完成:
+sig := make(chan os.Signal, 1)
+signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+<-sig
+<-done
+释放备份文件的锁之后，其它进程即可使用该备份文件，SaveToDiscOnce不再存盘，直接返回错误。
+收到SIGUSR1(Windows等不支持该信号的系统除外)时，立即存盘一次，程序继续运行。
+存盘与定期存盘不会同时进行，正在定期存盘时会等待其完成。
+onSave为可选参数，每次由信号触发的存盘完成后调用，报告收到的信号及存盘结果
+*/
+func (r *Rule) SaveOnSignal(onSave ...func(sig os.Signal, err error)) <-chan struct{} {
+	if !r.needBackup {
+		panic("If you want't to SaveOnSignal,you should use LoadingAndAutoSaveToDisc after AddRule.")
+	}
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, append(shutdownSignals, saveSignals...)...)
+	go func() {
+		for sig := range c {
+			shutdown := false
+			for _, s := range shutdownSignals {
+				shutdown = shutdown || sig == s
+			}
+			if shutdown {
+				r.stopAutoSaveOnce.Do(func() { close(r.stopAutoSave) })
+			}
+			err := r.saveExclusively()
+			for _, fn := range onSave {
+				fn(sig, err)
+			}
+			if shutdown {
+				signal.Stop(c)
+				r.releaseBackupFile()
+				close(done)
+				//停止监听后重新发送,程序没有处理该信号时按默认方式退出
+				if p, err := os.FindProcess(os.Getpid()); err == nil {
+					p.Signal(sig)
+				}
+				return
+			}
+		}
+	}()
+	return done
+}
+
+//存盘,并与定期存盘互斥,定期存盘正在进行时,等待其完成后再存盘
+func (r *Rule) saveExclusively() error {
+	for !r.finished.CompareAndSwap(true, false) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	defer r.finished.Store(true)
+	return r.SaveToDiscOnce()
+}
+
+//释放备份文件的锁之后再存盘时返回的错误
+var errBackupFileReleased = errors.New("the backup file has been released,it may be used by another process now")
+
+//释放备份文件的锁,以便新启动的进程可以立即使用该备份文件,之后SaveToDiscOnce返回errBackupFileReleased
+func (r *Rule) releaseBackupFile() {
+	r.lockerForBackup.Lock()
+	defer r.lockerForBackup.Unlock()
+	if r.backupFileLock != nil {
+		unlockFile(r.backupFileLock)
+		r.backupFileLock = nil
+	}
+}
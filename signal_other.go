@@ -0,0 +1,16 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+//go:build windows || plan9 || js
+
+package ratelimit
+
+import (
+	"os"
+)
+
+//当前系统不支持SIGUSR1,无法由信号触发存盘
+var saveSignals []os.Signal
@@ -0,0 +1,73 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+//go:build !windows && !plan9 && !js
+
+package ratelimit
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_saveOnSignal(t *testing.T) {
+	dir := t.TempDir()
+	r := NewRule()
+	r.AddRule(time.Minute, 10)
+	r.SetSaveOptions(SaveOptions{Directory: dir})
+	r.LoadingAndAutoSaveToDisc("signal", time.Hour)
+	r.AllowVisit("ydg")
+	saved := make(chan error, 1)
+	done := r.SaveOnSignal(func(sig os.Signal, err error) {
+		if sig == syscall.SIGUSR1 {
+			saved <- err
+		}
+	})
+	syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	select {
+	case err := <-saved:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no save after SIGUSR1")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "signal.ratelimit")); err != nil {
+		t.Fatal(err)
+	}
+	if stats := r.LastSaveStatistics(); stats.Keys != 1 {
+		t.Fatalf("unexpected save statistics: %+v", stats)
+	}
+	//收到SIGTERM后做最后一次存盘并释放锁,再把信号重新发送给本进程,
+	//测试自己监听该信号,以免按默认方式处理时测试进程退出
+	term := make(chan os.Signal, 2)
+	signal.Notify(term, syscall.SIGTERM)
+	defer signal.Stop(term)
+	r.AllowVisit("andy")
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("no final save after SIGTERM")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-term:
+		case <-time.After(time.Second * 5):
+			t.Fatal("expected SIGTERM to be raised again after the final save")
+		}
+	}
+	if stats := r.LastSaveStatistics(); stats.Keys != 2 {
+		t.Fatalf("unexpected save statistics: %+v", stats)
+	}
+	if err := r.SaveToDiscOnce(); err != errBackupFileReleased {
+		t.Fatalf("expected errBackupFileReleased,got %v", err)
+	}
+}
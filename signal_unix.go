@@ -0,0 +1,17 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+//go:build !windows && !plan9 && !js
+
+package ratelimit
+
+import (
+	"os"
+	"syscall"
+)
+
+//收到后立即存盘一次的信号
+var saveSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,357 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_shardedIndexConcurrent(t *testing.T) {
+	s := createsingleRule(new(keyLimit), nil, 0, time.Hour, time.Second, 1000, 0)
+	stop := make(chan struct{})
+	var cleaner sync.WaitGroup
+	cleaner.Add(1)
+	go func() {
+		defer cleaner.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.deleteExpiredOnce()
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := "user_" + strconv.Itoa(g) + "_" + strconv.Itoa(i)
+				for ii := 0; ii < 10; ii++ {
+					s.add(key)
+				}
+				//清空后由清理协程回收队列,并可能马上分配给其它用户
+				if i%2 == 0 {
+					s.manualEmptyVisitorRecordsOf(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(stop)
+	cleaner.Wait()
+	for g := 0; g < 8; g++ {
+		for i := 0; i < 100; i++ {
+			want := 990
+			if i%2 == 0 {
+				want = 1000
+			}
+			key := "user_" + strconv.Itoa(g) + "_" + strconv.Itoa(i)
+			if remaining := s.remainingVisits(key); remaining != want {
+				t.Fatalf("%s: expected %d remaining visits,got %d", key, want, remaining)
+			}
+		}
+	}
+}
+
+func Test_shardedIndexRecycle(t *testing.T) {
+	s := createsingleRule(new(keyLimit), nil, 0, time.Hour, time.Second, 10, 0)
+	s.add("a")
+	s.manualEmptyVisitorRecordsOf("a")
+	if s.exists("a") {
+		t.Fatal("expected the empty key to be released")
+	}
+	s.add(int64(1))
+	s.add(int64(1))
+	if remaining := s.remainingVisits("a"); remaining != 10 {
+		t.Fatalf("expected released key to have all visits,got %d", remaining)
+	}
+	if remaining := s.remainingVisits(int64(1)); remaining != 8 {
+		t.Fatalf("expected 8 remaining visits,got %d", remaining)
+	}
+}
+
+func Test_shardedIndexCompact(t *testing.T) {
+	s := createsingleRule(new(keyLimit), nil, 0, time.Hour, time.Second, 10, 0)
+	//高峰期间的用户全部清空并回收,只留下一个用户
+	for i := 0; i < 10000; i++ {
+		s.add(int64(i))
+	}
+	for i := 1; i < 10000; i++ {
+		s.manualEmptyVisitorRecordsOf(int64(i))
+	}
+	s.compact()
+	for i := range s.shards {
+		if s.shards[i].peak > 1 || cap(s.shards[i].expiry) > compactMinPeak {
+			t.Fatalf("expected shard %d to be rebuilt,peak %d", i, s.shards[i].peak)
+		}
+	}
+	//只剩一个用户的队列
+	if bytes := s.limit.bytes.Load(); bytes != queueBytes(s.lookup(int64(0))) {
+		t.Fatalf("unexpected bytes after compaction: %d", bytes)
+	}
+	if remaining := s.remainingVisits(int64(0)); remaining != 9 {
+		t.Fatalf("expected 9 remaining visits,got %d", remaining)
+	}
+}
+
+//改为分片索引之前的实现:所有用户共用一个sync.Map及一把读写锁,仅用于性能对比
+type baselineKeyIndex struct {
+	numberOfAllowedAccesses    int
+	visitorRecords             []*autoGrowCircleQueueInt64
+	usedVisitorRecordsIndex    sync.Map
+	notUsedVisitorRecordsIndex map[int]struct{}
+	lockerForKeyIndex          sync.RWMutex
+}
+
+func newBaselineKeyIndex(numberOfAllowedAccesses int) *baselineKeyIndex {
+	return &baselineKeyIndex{numberOfAllowedAccesses: numberOfAllowedAccesses, notUsedVisitorRecordsIndex: make(map[int]struct{})}
+}
+
+func (s *baselineKeyIndex) getIndexFrom(key interface{}) int {
+	s.lockerForKeyIndex.RLock()
+	if index, exist := s.usedVisitorRecordsIndex.Load(key); exist {
+		s.lockerForKeyIndex.RUnlock()
+		return index.(int)
+	}
+	s.lockerForKeyIndex.RUnlock()
+	s.lockerForKeyIndex.Lock()
+	defer s.lockerForKeyIndex.Unlock()
+	if index, exist := s.usedVisitorRecordsIndex.Load(key); exist {
+		return index.(int)
+	}
+	for index := range s.notUsedVisitorRecordsIndex {
+		delete(s.notUsedVisitorRecordsIndex, index)
+		s.usedVisitorRecordsIndex.Store(key, index)
+		return index
+	}
+	queue := newAutoGrowCircleQueueInt64(s.numberOfAllowedAccesses, 0)
+	queue.key = key
+	s.visitorRecords = append(s.visitorRecords, queue)
+	index := len(s.visitorRecords) - 1
+	s.usedVisitorRecordsIndex.Store(key, index)
+	return index
+}
+
+func (s *baselineKeyIndex) add(key interface{}) error {
+	index := s.getIndexFrom(key)
+	//原实现中读取visitorRecords时未加锁,与append之间存在数据竞争,此处加读锁后再读取
+	s.lockerForKeyIndex.RLock()
+	q := s.visitorRecords[index]
+	s.lockerForKeyIndex.RUnlock()
+	q.locker.Lock()
+	defer q.locker.Unlock()
+	q.deleteExpired()
+	return q.pushWithConcurrencysafety(time.Minute)
+}
+
+//分别用goroutines个协程完成b.N次访问,每次访问的key由keyOf生成
+func benchmarkAdd(b *testing.B, goroutines int, add func(key interface{}) error, keyOf func(g, i int) interface{}) {
+	var next int64
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i > b.N {
+					return
+				}
+				add(keyOf(g, i))
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+//每次访问都是新用户,即新用户集中涌入的情况
+func newKeyOf(g, i int) interface{} {
+	return int64(i)
+}
+
+//1024个老用户反复访问
+func hotKeyOf(g, i int) interface{} {
+	return int64(i & 1023)
+}
+
+func BenchmarkKeyIndex(b *testing.B) {
+	for _, workload := range []struct {
+		name  string
+		keyOf func(g, i int) interface{}
+	}{{"NewKeys", newKeyOf}, {"HotKeys", hotKeyOf}} {
+		for _, goroutines := range []int{1, 8, 64} {
+			name := workload.name + "/goroutines=" + strconv.Itoa(goroutines)
+			b.Run("Sharded/"+name, func(b *testing.B) {
+				s := createsingleRule(new(keyLimit), nil, 0, time.Minute, time.Second, 10, 0)
+				benchmarkAdd(b, goroutines, s.add, workload.keyOf)
+			})
+			b.Run("Baseline/"+name, func(b *testing.B) {
+				s := newBaselineKeyIndex(10)
+				benchmarkAdd(b, goroutines, s.add, workload.keyOf)
+			})
+		}
+	}
+}
+
+func Test_expiryHeap(t *testing.T) {
+	s := createsingleRule(new(keyLimit), nil, 0, time.Millisecond*100, time.Second, 10, 0)
+	s.add("idle")
+	s.add("active")
+	time.Sleep(time.Millisecond * 60)
+	s.add("active")
+	time.Sleep(time.Millisecond * 60)
+	s.deleteExpiredOnce()
+	if s.exists("idle") || !s.exists("active") {
+		t.Fatal("expected only the idle key to be released")
+	}
+	//active在首次到期检查时重新入堆,其最新的访问记录过期后被删除
+	time.Sleep(time.Millisecond * 60)
+	s.deleteExpiredOnce()
+	if s.exists("active") {
+		t.Fatal("expected the active key to be released after its last record expired")
+	}
+}
+
+//改为按到期时间清除之前的实现:每次遍历所有用户,仅用于性能对比
+func scanDeleteExpired(s *singleRule) {
+	s.rangeKeys(func(key interface{}, q *autoGrowCircleQueueInt64) bool {
+		if !q.lockFor(s, key) {
+			return true
+		}
+		q.deleteExpired()
+		empty := q.usedSize() == 0
+		q.locker.Unlock()
+		if empty {
+			s.releaseIfEmpty(key)
+		}
+		return true
+	})
+}
+
+//10万个用户的访问记录均未过期时,每次清除过期数据的开销
+func BenchmarkDeleteExpired(b *testing.B) {
+	s := createsingleRule(new(keyLimit), nil, 0, time.Hour, time.Second, 10, 0)
+	for i := 0; i < 100000; i++ {
+		s.add(int64(i))
+	}
+	b.Run("Heap", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s.deleteExpiredOnce()
+		}
+	})
+	b.Run("Scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			scanDeleteExpired(s)
+		}
+	})
+}
+
+func Test_allowVisitNoAllocs(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Minute, 100)
+	r.AddRule(time.Hour, 1000)
+	key := strconv.Itoa(123456)
+	r.AllowVisitString(key)
+	r.AllowVisitUint64(123456)
+	//包括超出访问次数后被拒绝的访问
+	if allocs := testing.AllocsPerRun(200, func() { r.AllowVisitString(key) }); allocs != 0 {
+		t.Fatalf("expected AllowVisitString to not allocate for a known key,got %v allocs", allocs)
+	}
+	if allocs := testing.AllocsPerRun(200, func() { r.AllowVisitUint64(123456) }); allocs != 0 {
+		t.Fatalf("expected AllowVisitUint64 to not allocate for a known key,got %v allocs", allocs)
+	}
+	if r.AllowVisit(key) || r.RemainingVisits(uint64(123456))[0] != 0 {
+		t.Fatal("expected typed keys to share records with interface keys")
+	}
+}
+
+func BenchmarkAllowVisit(b *testing.B) {
+	r := NewRule()
+	r.AddRule(time.Minute, 1<<30)
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "user_" + strconv.Itoa(i)
+		//只测试已访问过的用户
+		r.AllowVisit(keys[i])
+		r.AllowVisitUint64(uint64(i))
+	}
+	b.Run("Interface", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.AllowVisit(keys[i&1023])
+		}
+	})
+	b.Run("String", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.AllowVisitString(keys[i&1023])
+		}
+	})
+	b.Run("Uint64", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r.AllowVisitUint64(uint64(i & 1023))
+		}
+	})
+}
+
+func Test_ruleClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	rules := make([]*Rule, 100)
+	for i := range rules {
+		rules[i] = NewRule()
+		rules[i].AddRule(time.Minute, 20)
+		rules[i].AddRule(time.Hour, 200)
+	}
+	//未使用的分片不创建索引
+	for i := range rules[0].rules[0].shards {
+		if rules[0].rules[0].shards[i].queues != nil {
+			t.Fatalf("expected shard %d to have no index before the first key", i)
+		}
+	}
+	for _, r := range rules {
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//清除过期数据的协程均已退出
+	deadline := time.Now().Add(time.Second * 5)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected cleanup goroutines to exit,%d goroutines before,%d now", before, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	//开启备份时做最后一次存盘并释放备份文件的锁
+	r := NewRule()
+	r.AddRule(time.Minute, 10)
+	r.SetSaveOptions(SaveOptions{Directory: t.TempDir()})
+	r.LoadingAndAutoSaveToDisc("close", time.Hour)
+	r.AllowVisit("ydg")
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := r.LastSaveStatistics(); stats.Keys != 1 {
+		t.Fatalf("unexpected save statistics: %+v", stats)
+	}
+	if err := r.SaveToDiscOnce(); err != errBackupFileReleased {
+		t.Fatalf("expected errBackupFileReleased,got %v", err)
+	}
+}
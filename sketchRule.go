@@ -0,0 +1,163 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"math/bits"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+近似规则:不为每个用户保存访问记录,而是用count-min sketch统计各用户的访问次数,内存只与width及depth有关,与用户数无关,
+适合匿名IP等用户数达到千万级而又不需要精确计数的情况。
+计时周期被分为sketchSubWindows个子周期,每个子周期一个sketch,连同当前正在进行的子周期共sketchSubWindows+1个sketch轮流使用,
+统计访问次数时累加最近sketchSubWindows+1个子周期,最早的一个子周期可能已部分超出计时周期,
+所以访问记录不会提前过期,最多推迟一个子周期(计时周期的1/sketchSubWindows)过期。
+count-min sketch只会多计而不会少计,设计时周期内所有用户的访问次数共计N次,则某用户的访问次数至少以1-e^(-depth)的概率
+不超过实际次数加上e/width*N(e为自然常数),即实际访问次数未达上限的用户有可能被误判为超出上限,但超出上限的用户不会被放过。
+每次访问先计入计数器再统计访问次数,超出上限时撤销,同一用户的并发访问都能看到彼此计入的次数,不会同时以上限减1的次数通过,
+但并发访问时,之后被撤销的访问也可能使其它访问被拒绝,即并发量很大时允许的访问次数可能略少于上限
+*/
+
+//每条近似规则的子周期数
+const sketchSubWindows = 10
+
+//一个子周期的sketch
+type sketchWindow struct {
+	epoch    atomic.Int64    //当前统计的是第几个子周期(以UnixNano除以子周期的长度计)
+	counters []atomic.Uint32 //depth行,每行width个计数器
+}
+
+//单组近似访问控制策略
+type sketchRule struct {
+	defaultExpiration       time.Duration //计时周期
+	numberOfAllowedAccesses int           //在计时周期内最多允许访问的次数
+	width                   int
+	depth                   int
+	subWindow               int64                              //子周期的长度,纳秒
+	windows                 [sketchSubWindows + 1]sketchWindow //按子周期的序号轮流使用
+	lockerForRotate         sync.Mutex                         //切换子周期时清空计数器
+	allowed                 atomic.Uint64                      //被允许的访问次数,见metrics.go
+	denied                  atomic.Uint64                      //被拒绝的访问次数
+}
+
+/*
+增加近似访问控制策略,例:
+r.AddApproximateRule(time.Minute, 100, 1<<20, 4)
+表示在1分钟内每个IP最多允许访问100次,每个子周期使用4行、每行2^20个计数器,共占用11*4*2^20*4字节即176MB内存。
+若1分钟内所有IP共访问1000万次,则某IP的访问次数至少以1-e^(-4)即98%的概率多计不超过e/2^20*1000万即约26次。
+近似规则与AddRule增加的规则同时生效,不备份到硬盘,也不计入各种统计,
+不支持RemainingVisits,ManualEmptyVisitorRecordsOf等需要具体访问记录的函数
+*/
+func (r *Rule) AddApproximateRule(defaultExpiration time.Duration, numberOfAllowedAccesses int, width, depth int) {
+	r.mustBeWritable()
+	if defaultExpiration < sketchSubWindows {
+		panic("the rule's duration is too short: " + defaultExpiration.String())
+	}
+	if width <= 0 || depth <= 0 || depth > 64 {
+		panic("illegal width or depth of count-min sketch: " + strconv.Itoa(width) + "," + strconv.Itoa(depth))
+	}
+	if numberOfAllowedAccesses <= 0 {
+		numberOfAllowedAccesses = 1
+	}
+	s := &sketchRule{
+		defaultExpiration:       defaultExpiration,
+		numberOfAllowedAccesses: numberOfAllowedAccesses,
+		width:                   width,
+		depth:                   depth,
+		subWindow:               int64(defaultExpiration / sketchSubWindows),
+	}
+	for i := range s.windows {
+		s.windows[i].counters = make([]atomic.Uint32, width*depth)
+	}
+	r.sketches = append(r.sketches, s)
+}
+
+//近似规则拒绝访问的原因
+func (s *sketchRule) decision() Decision {
+	return Decision{Reason: DenyRateLimited, Window: s.defaultExpiration, Limit: s.numberOfAllowedAccesses, Approximate: true}
+}
+
+//是否允许访问,允许访问则计入一次访问,h为keyHash计算的哈希值
+func (s *sketchRule) allowVisit(h uint64) bool {
+	slot := nowUnixNano() / s.subWindow
+	w := s.current(slot)
+	h2 := sketchHash2(h)
+	for i := 0; i < s.depth; i++ {
+		w.counters[i*s.width+s.column(h, h2, i)].Add(1)
+	}
+	if s.estimate(h, slot) > s.numberOfAllowedAccesses {
+		//撤销本次计入的访问
+		for i := 0; i < s.depth; i++ {
+			decrementCounter(&w.counters[i*s.width+s.column(h, h2, i)])
+		}
+		s.denied.Add(1)
+		return false
+	}
+	s.allowed.Add(1)
+	return true
+}
+
+//计数器减1,计数器在此期间因进入新的子周期被清零时不再减,以免下溢
+func decrementCounter(c *atomic.Uint32) {
+	for {
+		n := c.Load()
+		if n == 0 || c.CompareAndSwap(n, n-1) {
+			return
+		}
+	}
+}
+
+//计时周期内的访问次数,取各行中最小的一个
+func (s *sketchRule) estimate(h uint64, slot int64) int {
+	h2 := sketchHash2(h)
+	min := -1
+	for i := 0; i < s.depth; i++ {
+		index := i*s.width + s.column(h, h2, i)
+		n := 0
+		for ii := range s.windows {
+			w := &s.windows[ii]
+			if epoch := w.epoch.Load(); epoch >= slot-sketchSubWindows && epoch <= slot {
+				n += int(w.counters[index].Load())
+			}
+		}
+		if min < 0 || n < min {
+			min = n
+		}
+	}
+	return min
+}
+
+//第i行中的列,由两个哈希值组合得到各行的哈希值
+func (s *sketchRule) column(h, h2 uint64, i int) int {
+	hi, _ := bits.Mul64(h+uint64(i)*h2, uint64(s.width))
+	return int(hi)
+}
+
+//当前子周期的sketch,进入新的子周期时清空其计数器
+func (s *sketchRule) current(slot int64) *sketchWindow {
+	w := &s.windows[slot%(sketchSubWindows+1)]
+	if w.epoch.Load() != slot {
+		s.lockerForRotate.Lock()
+		if w.epoch.Load() < slot {
+			for i := range w.counters {
+				w.counters[i].Store(0)
+			}
+			w.epoch.Store(slot)
+		}
+		s.lockerForRotate.Unlock()
+	}
+	return w
+}
+
+//由keyHash计算的哈希值生成第二个哈希值,须为奇数
+func sketchHash2(h uint64) uint64 {
+	return mixUint64(h^0x9e3779b97f4a7c15) | 1
+}
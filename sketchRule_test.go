@@ -0,0 +1,92 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_sketchRuleLimit(t *testing.T) {
+	r := NewRule()
+	r.AddApproximateRule(time.Minute, 10, 1024, 4)
+	for i := 0; i < 10; i++ {
+		if !r.AllowVisitString("ydg") {
+			t.Fatalf("visit %d: expected to be allowed", i)
+		}
+	}
+	if r.AllowVisit("ydg") {
+		t.Fatal("expected the 11th visit to be denied")
+	}
+	//其它用户不受影响
+	if !r.AllowVisitUint64(10086) || !r.AllowVisit(uint64(10086)) {
+		t.Fatal("expected another key to be allowed")
+	}
+}
+
+func Test_sketchRuleErrorBound(t *testing.T) {
+	r := NewRule()
+	r.AddApproximateRule(time.Hour, 5, 1<<16, 4)
+	//大量用户各访问一次后,仍有访问次数的用户比例
+	const users = 10000
+	for i := 0; i < users; i++ {
+		r.AllowVisitUint64(uint64(i))
+	}
+	denied := 0
+	for i := users; i < 2*users; i++ {
+		if !r.AllowVisitUint64(uint64(i)) {
+			denied++
+		}
+	}
+	//共访问2万次,e/2^16*2万不到1,多计超过4次(即误判)的概率很小
+	if denied > users/100 {
+		t.Fatalf("expected few false denials,got %d of %d", denied, users)
+	}
+}
+
+func Test_sketchRuleExpiration(t *testing.T) {
+	r := NewRule()
+	r.AddApproximateRule(time.Millisecond*100, 1, 64, 2)
+	if !r.AllowVisit("ydg") || r.AllowVisit("ydg") {
+		t.Fatal("expected only one visit to be allowed")
+	}
+	//最多推迟一个子周期过期
+	time.Sleep(time.Millisecond * 120)
+	if !r.AllowVisit("ydg") {
+		t.Fatal("expected the visit to expire")
+	}
+}
+
+func Test_sketchRuleConcurrent(t *testing.T) {
+	r := NewRule()
+	r.AddApproximateRule(time.Minute, 10, 1<<16, 4)
+	//每轮换一个用户,各协程同时开始访问,并发访问时不能超出上限
+	for round := uint64(0); round < 50; round++ {
+		var allowed atomic.Int64
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for i := 0; i < 64; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				for ii := 0; ii < 4; ii++ {
+					if r.AllowVisitUint64(round) {
+						allowed.Add(1)
+					}
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+		if n := allowed.Load(); n == 0 || n > 10 {
+			t.Fatalf("round %d: expected at most 10 visits to be allowed,got %d", round, n)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+//备份文件格式
+const (
+	BackupFormatLegacy  = iota //原始格式,所有数字均以8字节定长存储
+	BackupFormatCompact        //紧凑格式,key及访问记录均以varint存储,同一key下的访问记录做差分编码
+)
+
+//备份文件压缩方式
+const (
+	CompressionNone = iota //不压缩
+	CompressionGzip        //gzip压缩
+)
+
+//数据备份选项,加载时会自动识别备份文件的格式及压缩方式,无需指定
+type SaveOptions struct {
+	Format      int       //备份文件格式,默认为BackupFormatLegacy
+	Compression int       //压缩方式,默认为CompressionNone
+	Directory   string    //备份文件所在目录,备份文件名为相对路径时有效,需在LoadingAndAutoSaveToDisc之前设置,默认为当前目录
+	Retention   Retention //历史备份的保留策略,默认不保留历史备份
+	//加密备份数据所用密钥的标识,密钥需先通过RegisterEncryptionKey注册,默认不加密;
+	//加载时根据备份文件中记录的密钥标识自动选择密钥,未加密的备份文件也可以正常加载
+	EncryptionKeyID string
+	//加载时访问记录最晚只能是加载时间加上计时周期,重启后系统时间比存盘时慢(例如时钟未同步)时会超出,
+	//ClockSkewTolerance表示允许超出的时长,默认为0,即不允许超出
+	ClockSkewTolerance time.Duration
+	//超出ClockSkewTolerance的访问记录调整为允许的最大值,即视为刚刚访问(ClockSkewTolerance为0时),而不是加载失败,默认为false
+	ClampFutureRecords bool
+}
+
+//最近一次存盘或加载的统计数据,各条规则分别计数,即同一用户在多条规则中都有访问记录时会被计算多次
+type BackupStatistics struct {
+	Time                  time.Time //存盘或加载的时间
+	Keys                  int       //实际存盘或加载的用户数
+	Records               int       //实际存盘或加载的访问记录数
+	SkippedExpiredRecords int       //因已过期而跳过的访问记录数
+	SkippedEmptyKeys      int       //因没有未过期的访问记录而跳过的用户数
+	ClampedRecords        int       //加载时因超出允许的最大值而被调整的访问记录数,见SaveOptions.ClampFutureRecords
+}
+
+var (
+	errBackupRulesDifferent = errors.New("backup rules is inconsistent with current rules")
+	gzipMagic               = []byte{0x1f, 0x8b}
+)
+
+//备份数据在内存中的表示形式,存盘时由各规则生成,加载时由备份文件解析而来
+type snapshot struct {
+	format      int
+	compression int
+	savedAt     int64  //存盘时间,仅紧凑格式有记录
+	keyID       string //加密所用密钥的标识,未加密时为空
+	ruleNum     int    //文件头中记录的规则数量,备份文件损坏时可能大于rules的长度
+	rules       []*snapshotRule
+}
+
+//单条规则的备份数据
+type snapshotRule struct {
+	index      int
+	expiration time.Duration //仅紧凑格式有记录,原始格式中为0
+	limit      int           //仅紧凑格式有记录,原始格式中为0
+	keys       []snapshotKey
+}
+
+//单个key的备份数据
+type snapshotKey struct {
+	key     interface{}
+	records []int64
+	offset  int64 //key在(解压后的)备份数据中的位置,用于出错时定位
+}
+
+//备份数据的编码器,每种备份文件格式对应一种编码器
+type snapshotEncoder interface {
+	writeHeader(ruleNum int) error
+	writeRule(sr *snapshotRule) error
+}
+
+//把备份数据按指定格式写入w,ruleAt用于依次获取每条规则的备份数据,以免一次性占用过多内存
+func writeSnapshot(w io.Writer, opts SaveOptions, ruleNum int, ruleAt func(i int) *snapshotRule) (err error) {
+	//加密在压缩之后进行,压缩后的数据再加密
+	var ew *encryptWriter
+	if opts.EncryptionKeyID != "" {
+		if ew, err = newEncryptWriter(w, opts.EncryptionKeyID); err != nil {
+			return err
+		}
+		w = ew
+	}
+	var zw *gzip.Writer
+	switch opts.Compression {
+	case CompressionNone:
+	case CompressionGzip:
+		zw = gzip.NewWriter(w)
+		w = zw
+	default:
+		return fmt.Errorf("unknown backup compression:%d", opts.Compression)
+	}
+	buf := bufio.NewWriterSize(w, 40960)
+	var enc snapshotEncoder
+	switch opts.Format {
+	case BackupFormatLegacy:
+		enc = &legacyEncoder{w: buf}
+	case BackupFormatCompact:
+		enc = &compactEncoder{w: buf}
+	default:
+		return fmt.Errorf("unknown backup format:%d", opts.Format)
+	}
+	if err = enc.writeHeader(ruleNum); err != nil {
+		return err
+	}
+	for i := 0; i < ruleNum; i++ {
+		if err = enc.writeRule(ruleAt(i)); err != nil {
+			return err
+		}
+	}
+	if err = buf.Flush(); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err = zw.Close(); err != nil {
+			return err
+		}
+	}
+	if ew != nil {
+		return ew.Close()
+	}
+	return nil
+}
+
+//从rd中解析备份数据,自动识别加密,压缩方式及备份文件格式
+func readSnapshot(rd io.Reader) (*snapshot, error) {
+	s, err := decodeSnapshot(rd, &snapshotReader{})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//解析备份数据,出错时返回已解析的部分,检查模式下用于修复备份文件
+func decodeSnapshot(rd io.Reader, sr *snapshotReader) (*snapshot, error) {
+	br := bufio.NewReaderSize(rd, 40960)
+	var keyID string
+	if head, _ := br.Peek(len(encryptionMagic)); bytes.Equal(head, encryptionMagic) {
+		id, dr, err := newDecryptReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReaderSize(dr, 40960)
+		keyID = id
+	}
+	compression := CompressionNone
+	if head, _ := br.Peek(len(gzipMagic)); bytes.Equal(head, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		br = bufio.NewReaderSize(zr, 40960)
+		compression = CompressionGzip
+	}
+	sr.r = br
+	var s *snapshot
+	var err error
+	if head, _ := br.Peek(len(compactMagic)); bytes.Equal(head, compactMagic) {
+		s, err = decodeCompact(sr)
+	} else {
+		s, err = decodeLegacy(sr)
+	}
+	s.compression = compression
+	s.keyID = keyID
+	return s, err
+}
+
+//备份数据的读取器,记录当前读取位置以便出错时定位
+type snapshotReader struct {
+	r   *bufio.Reader
+	pos int64
+	//检查模式:访问记录顺序错乱,超出上限或者key类型未注册时,记录问题并继续解析,而不是直接返回错误
+	tolerant bool
+	now      int64           //检查访问记录上限时使用的时间
+	windows  []time.Duration //原始格式的备份文件中未记录计时周期,检查模式下由调用者提供
+	problems []BackupProblem
+}
+
+//检查模式下记录问题并继续解析,否则直接返回错误
+func (s *snapshotReader) problem(offset int64, rule int, key interface{}, err error) error {
+	if !s.tolerant {
+		return err
+	}
+	s.problems = append(s.problems, BackupProblem{Offset: offset, Rule: rule, Key: key, Message: err.Error()})
+	return nil
+}
+
+//检查模式下访问记录允许的最大值,计时周期未知或者非检查模式下返回0,即不检查
+func (s *snapshotReader) maxRecord(rule int, expiration time.Duration) int64 {
+	if !s.tolerant {
+		return 0
+	}
+	if expiration == 0 && rule < len(s.windows) {
+		expiration = s.windows[rule]
+	}
+	if expiration == 0 {
+		return 0
+	}
+	return s.now + int64(expiration)
+}
+
+//检查一条访问记录是否合法,返回false表示该key的数据已损坏,需丢弃
+func (s *snapshotReader) checkRecord(offset int64, rule int, key interface{}, pre, cur, max int64) (bool, error) {
+	if cur < pre {
+		return false, s.problem(offset, rule, key, errRecordOrder(offset))
+	}
+	if max != 0 && cur > max {
+		return false, s.problem(offset, rule, key, fmt.Errorf("record %s is later than the allowed maximum %s,the location is:%d",
+			time.Unix(0, cur).Format(time.RFC3339Nano), time.Unix(0, max).Format(time.RFC3339Nano), offset))
+	}
+	return true, nil
+}
+
+//用注册的编解码器对key解码,检查模式下未注册的类型以原始数据保存
+func (s *snapshotReader) decodeCustomKey(tag uint8, data []byte) (interface{}, error) {
+	key, err := decodeCustomKey(tag, data)
+	if s.tolerant && errors.Is(err, errUnknownKeyType) {
+		return unknownKey{tag: tag, data: string(data)}, nil
+	}
+	return key, err
+}
+
+func (s *snapshotReader) ReadByte() (byte, error) {
+	b, err := s.r.ReadByte()
+	if err == nil {
+		s.pos++
+	}
+	return b, err
+}
+
+func (s *snapshotReader) readFull(b []byte) error {
+	n, err := io.ReadFull(s.r, b)
+	s.pos += int64(n)
+	return err
+}
+
+func (s *snapshotReader) readUint64() (uint64, error) {
+	var b [8]byte
+	if err := s.readFull(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b[:]), nil
+}
+
+func (s *snapshotReader) readUvarint() (uint64, error) {
+	return binary.ReadUvarint(s)
+}
+
+func (s *snapshotReader) readVarint() (int64, error) {
+	return binary.ReadVarint(s)
+}
+
+//读取指定长度的数据,长度来自备份文件,不可信,所以不预先分配过大的空间
+func (s *snapshotReader) readBytes(n uint64) ([]byte, error) {
+	if n > math.MaxInt32 {
+		return nil, fmt.Errorf("data length %d is too large,the location is:%d", n, s.pos)
+	}
+	var b bytes.Buffer
+	copied, err := io.CopyN(&b, s.r, int64(n))
+	s.pos += copied
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return b.Bytes(), err
+}
+
+func (s *snapshotReader) readString(n uint64) (string, error) {
+	b, err := s.readBytes(n)
+	return string(b), err
+}
+
+//访问记录按先后顺序排列,过期的只可能在前面,返回其中已过期的记录数
+func expiredPrefix(records []int64, now int64) int {
+	expired := 0
+	for expired < len(records) && now > records[expired] {
+		expired++
+	}
+	return expired
+}
+
+//访问记录必须依次变大，否则不合法
+func errRecordOrder(location int64) error {
+	return fmt.Errorf("The backup file has been illegally modified and has become invalid,the location is:%d", location)
+}
@@ -0,0 +1,231 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"time"
+)
+
+/*
+紧凑备份文件格式,除特别说明外,数字均以varint存储:
+文件头标识"RLSNAP"及版本号(1字节) 存盘时间 规则数量
+	规则下标 计时周期(纳秒) 允许访问次数 key数量
+		key类型(1字节,与原始格式相同) key(string及自定义类型为长度+内容,有符号整数为zigzag varint,无符号整数为uvarint)
+		访问记录数量 第一条访问记录 后续每条访问记录与前一条的差值
+访问记录一般在计时周期内密集分布,差分之后通常只需2至5个字节,远小于原始格式的8字节
+*/
+
+var compactMagic = []byte("RLSNAP\x01")
+
+type compactEncoder struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (e *compactEncoder) writeUvarint(i uint64) {
+	n := binary.PutUvarint(e.buf[:], i)
+	e.w.Write(e.buf[:n])
+}
+
+func (e *compactEncoder) writeVarint(i int64) {
+	n := binary.PutVarint(e.buf[:], i)
+	e.w.Write(e.buf[:n])
+}
+
+func (e *compactEncoder) writeHeader(ruleNum int) error {
+	e.w.Write(compactMagic)
+	e.writeVarint(nowUnixNano())
+	e.writeUvarint(uint64(ruleNum))
+	return nil
+}
+
+func (e *compactEncoder) writeRule(sr *snapshotRule) error {
+	e.writeUvarint(uint64(sr.index))
+	e.writeUvarint(uint64(sr.expiration))
+	e.writeUvarint(uint64(sr.limit))
+	e.writeUvarint(uint64(len(sr.keys)))
+	for _, k := range sr.keys {
+		switch key := k.key.(type) {
+		case string:
+			e.w.WriteByte(0x00)
+			e.writeUvarint(uint64(len(key)))
+			e.w.WriteString(key)
+		case int:
+			e.w.WriteByte(0x01)
+			e.writeVarint(int64(key))
+		case int8:
+			e.w.WriteByte(0x02)
+			e.writeVarint(int64(key))
+		case int16:
+			e.w.WriteByte(0x03)
+			e.writeVarint(int64(key))
+		case int32:
+			e.w.WriteByte(0x04)
+			e.writeVarint(int64(key))
+		case int64:
+			e.w.WriteByte(0x05)
+			e.writeVarint(key)
+		case uint:
+			e.w.WriteByte(0x06)
+			e.writeUvarint(uint64(key))
+		case uint8:
+			e.w.WriteByte(0x07)
+			e.writeUvarint(uint64(key))
+		case uint16:
+			e.w.WriteByte(0x08)
+			e.writeUvarint(uint64(key))
+		case uint32:
+			e.w.WriteByte(0x09)
+			e.writeUvarint(uint64(key))
+		case uint64:
+			e.w.WriteByte(0x0A)
+			e.writeUvarint(key)
+		default:
+			tag, data, err := encodeCustomKey(key)
+			if err != nil {
+				return err
+			}
+			e.w.WriteByte(tag)
+			e.writeUvarint(uint64(len(data)))
+			e.w.Write(data)
+		}
+		e.writeUvarint(uint64(len(k.records)))
+		//第一条记录存绝对值,之后只存与前一条记录的差值,差值用有符号数,以便加载时能发现顺序错乱的记录
+		var pre int64
+		for _, record := range k.records {
+			e.writeVarint(record - pre)
+			pre = record
+		}
+	}
+	return nil
+}
+
+//解析紧凑格式的备份数据,出错时返回已解析的部分
+func decodeCompact(sr *snapshotReader) (*snapshot, error) {
+	s := &snapshot{format: BackupFormatCompact}
+	magic := make([]byte, len(compactMagic))
+	if err := sr.readFull(magic); err != nil {
+		return s, err
+	}
+	var err error
+	if s.savedAt, err = sr.readVarint(); err != nil {
+		return s, err
+	}
+	rulesNum, err := sr.readUvarint()
+	if err != nil {
+		return s, err
+	}
+	s.ruleNum = int(rulesNum)
+	for i := 0; uint64(i) < rulesNum; i++ {
+		offset := sr.pos
+		var index, expiration, limit uint64
+		if index, err = sr.readUvarint(); err != nil {
+			return s, err
+		}
+		if expiration, err = sr.readUvarint(); err != nil {
+			return s, err
+		}
+		if limit, err = sr.readUvarint(); err != nil {
+			return s, err
+		}
+		curRuleKeyNum, err := sr.readUvarint()
+		if err != nil {
+			return s, err
+		}
+		rule := &snapshotRule{index: int(index), expiration: time.Duration(expiration), limit: int(limit)}
+		if rule.index != i {
+			if err = sr.problem(offset, i, nil, errBackupRulesDifferent); err != nil {
+				return s, err
+			}
+			rule.index = i
+		}
+		s.rules = append(s.rules, rule)
+		max := sr.maxRecord(i, rule.expiration)
+		for ii := uint64(0); ii < curRuleKeyNum; ii++ {
+			offset := sr.pos
+			keyType, err := sr.ReadByte()
+			if err != nil {
+				return s, err
+			}
+			var key interface{}
+			var signed int64
+			var unsigned uint64
+			switch keyType {
+			case 0:
+				if unsigned, err = sr.readUvarint(); err == nil {
+					key, err = sr.readString(unsigned)
+				}
+			case 1, 2, 3, 4, 5:
+				signed, err = sr.readVarint()
+				switch keyType {
+				case 1:
+					key = int(signed)
+				case 2:
+					key = int8(signed)
+				case 3:
+					key = int16(signed)
+				case 4:
+					key = int32(signed)
+				case 5:
+					key = signed
+				}
+			case 6, 7, 8, 9, 10:
+				unsigned, err = sr.readUvarint()
+				switch keyType {
+				case 6:
+					key = uint(unsigned)
+				case 7:
+					key = uint8(unsigned)
+				case 8:
+					key = uint16(unsigned)
+				case 9:
+					key = uint32(unsigned)
+				case 10:
+					key = unsigned
+				}
+			default:
+				var data []byte
+				if unsigned, err = sr.readUvarint(); err == nil {
+					if data, err = sr.readBytes(unsigned); err == nil {
+						key, err = sr.decodeCustomKey(keyType, data)
+					}
+				}
+			}
+			if err != nil {
+				return s, err
+			}
+			curKeyRecordsNum, err := sr.readUvarint()
+			if err != nil {
+				return s, err
+			}
+			k := snapshotKey{key: key, offset: offset}
+			valid := true
+			var preRecord int64
+			for iii := uint64(0); iii < curKeyRecordsNum; iii++ {
+				recordOffset := sr.pos
+				delta, err := sr.readVarint()
+				if err != nil {
+					return s, err
+				}
+				curRecord := preRecord + delta
+				ok, err := sr.checkRecord(recordOffset, i, key, preRecord, curRecord, max)
+				if err != nil {
+					return s, err
+				}
+				valid = valid && ok
+				k.records = append(k.records, curRecord)
+				preRecord = curRecord
+			}
+			if valid {
+				rule.keys = append(rule.keys, k)
+			}
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"bufio"
+)
+
+/*
+原始备份文件格式,所有数字均以8字节小端序存储:
+规则数量
+	规则下标 key数量
+		key类型(1字节) key(string及自定义类型为长度+内容,数字为8字节) 访问记录数量 访问记录...
+*/
+
+type legacyEncoder struct {
+	w *bufio.Writer
+}
+
+func (e *legacyEncoder) writeUint64(i uint64) {
+	e.w.Write(uint64ToByte(i))
+}
+
+func (e *legacyEncoder) writeHeader(ruleNum int) error {
+	e.writeUint64(uint64(ruleNum))
+	return nil
+}
+
+func (e *legacyEncoder) writeRule(sr *snapshotRule) error {
+	//先写当前下标,再写当前键的个数
+	e.writeUint64(uint64(sr.index))
+	e.writeUint64(uint64(len(sr.keys)))
+	for _, k := range sr.keys {
+		//写入key，key指用户名IP等，数字或string以外的类型需注册KeyCodec
+		switch key := k.key.(type) {
+		case string:
+			//与其它类型不同，KEY长度是不定长的
+			e.w.WriteByte(0x00)
+			e.writeUint64(uint64(len(key)))
+			e.w.WriteString(key)
+		case int:
+			e.w.WriteByte(0x01)
+			e.writeUint64(uint64(key))
+		case int8:
+			e.w.WriteByte(0x02)
+			e.writeUint64(uint64(key))
+		case int16:
+			e.w.WriteByte(0x03)
+			e.writeUint64(uint64(key))
+		case int32:
+			e.w.WriteByte(0x04)
+			e.writeUint64(uint64(key))
+		case int64:
+			e.w.WriteByte(0x05)
+			e.writeUint64(uint64(key))
+		case uint:
+			e.w.WriteByte(0x06)
+			e.writeUint64(uint64(key))
+		case uint8:
+			e.w.WriteByte(0x07)
+			e.writeUint64(uint64(key))
+		case uint16:
+			e.w.WriteByte(0x08)
+			e.writeUint64(uint64(key))
+		case uint32:
+			e.w.WriteByte(0x09)
+			e.writeUint64(uint64(key))
+		case uint64:
+			e.w.WriteByte(0x0A)
+			e.writeUint64(key)
+		default:
+			//其它类型由注册的KeyCodec编码,与string一样是不定长的
+			tag, data, err := encodeCustomKey(key)
+			if err != nil {
+				return err
+			}
+			e.w.WriteByte(tag)
+			e.writeUint64(uint64(len(data)))
+			e.w.Write(data)
+		}
+		//写下当前key对应的访问记录数及每条访问数据的时间点
+		e.writeUint64(uint64(len(k.records)))
+		for _, record := range k.records {
+			e.writeUint64(uint64(record))
+		}
+	}
+	return nil
+}
+
+//解析原始格式的备份数据,出错时返回已解析的部分
+func decodeLegacy(sr *snapshotReader) (*snapshot, error) {
+	s := &snapshot{format: BackupFormatLegacy}
+	rulesNum, err := sr.readUint64()
+	if err != nil {
+		return s, err
+	}
+	s.ruleNum = int(rulesNum)
+	for i := 0; uint64(i) < rulesNum; i++ {
+		offset := sr.pos
+		curIndex, err := sr.readUint64()
+		if err != nil {
+			return s, err
+		}
+		curRuleKeyNum, err := sr.readUint64()
+		if err != nil {
+			return s, err
+		}
+		rule := &snapshotRule{index: int(curIndex)}
+		if rule.index != i {
+			if err = sr.problem(offset, i, nil, errBackupRulesDifferent); err != nil {
+				return s, err
+			}
+			rule.index = i
+		}
+		s.rules = append(s.rules, rule)
+		max := sr.maxRecord(i, 0)
+		//有可能某条规则下面暂时没有历史记录
+		for ii := uint64(0); ii < curRuleKeyNum; ii++ {
+			offset := sr.pos
+			//获取键类型,以下每种类型对应存盘时的相应定义
+			keyType, err := sr.ReadByte()
+			if err != nil {
+				return s, err
+			}
+			var key interface{}
+			var tempKey uint64
+			switch {
+			case keyType == 0:
+				var n uint64
+				if n, err = sr.readUint64(); err == nil {
+					key, err = sr.readString(n)
+				}
+			case keyType <= 10:
+				tempKey, err = sr.readUint64()
+				switch keyType {
+				case 1:
+					key = int(tempKey)
+				case 2:
+					key = int8(tempKey)
+				case 3:
+					key = int16(tempKey)
+				case 4:
+					key = int32(tempKey)
+				case 5:
+					key = int64(tempKey)
+				case 6:
+					key = uint(tempKey)
+				case 7:
+					key = uint8(tempKey)
+				case 8:
+					key = uint16(tempKey)
+				case 9:
+					key = uint32(tempKey)
+				case 10:
+					key = tempKey
+				}
+			default:
+				var data []byte
+				if tempKey, err = sr.readUint64(); err == nil {
+					if data, err = sr.readBytes(tempKey); err == nil {
+						key, err = sr.decodeCustomKey(keyType, data)
+					}
+				}
+			}
+			if err != nil {
+				return s, err
+			}
+			curKeyRecordsNum, err := sr.readUint64()
+			if err != nil {
+				return s, err
+			}
+			k := snapshotKey{key: key, offset: offset}
+			valid := true
+			var preRecord int64
+			for iii := uint64(0); iii < curKeyRecordsNum; iii++ {
+				recordOffset := sr.pos
+				record, err := sr.readUint64()
+				if err != nil {
+					return s, err
+				}
+				//curRecord必须依次变大，否则不合法,检查模式下curRecord的值也不能太大，大过当前时间加上过期时间
+				curRecord := int64(record)
+				ok, err := sr.checkRecord(recordOffset, i, key, preRecord, curRecord, max)
+				if err != nil {
+					return s, err
+				}
+				valid = valid && ok
+				k.records = append(k.records, curRecord)
+				preRecord = curRecord
+			}
+			if valid {
+				rule.keys = append(rule.keys, k)
+			}
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func Test_snapshotFormats(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Hour*1, 100)
+	r.AddRule(time.Second*10, 5)
+	for i := 0; i < 3; i++ {
+		r.AllowVisit("ydg")
+		r.AllowVisit(int64(3232235522))
+		r.AllowVisit(uint8(7))
+	}
+	sizes := make(map[SaveOptions]int)
+	for _, opts := range []SaveOptions{
+		{Format: BackupFormatLegacy},
+		{Format: BackupFormatLegacy, Compression: CompressionGzip},
+		{Format: BackupFormatCompact},
+		{Format: BackupFormatCompact, Compression: CompressionGzip},
+	} {
+		var buf bytes.Buffer
+		err := writeSnapshot(&buf, opts, len(r.rules), func(i int) *snapshotRule {
+			return r.rules[i].snapshot(i, new(BackupStatistics))
+		})
+		if err != nil {
+			t.Fatalf("%+v: write: %v", opts, err)
+		}
+		sizes[opts] = buf.Len()
+		s, err := readSnapshot(&buf)
+		if err != nil {
+			t.Fatalf("%+v: read: %v", opts, err)
+		}
+		if s.format != opts.Format || s.compression != opts.Compression {
+			t.Fatalf("%+v: detected format %d compression %d", opts, s.format, s.compression)
+		}
+		restored := NewRule()
+		restored.AddRule(time.Hour*1, 100)
+		restored.AddRule(time.Second*10, 5)
+		if _, err = restored.restore(s, time.Now()); err != nil {
+			t.Fatalf("%+v: restore: %v", opts, err)
+		}
+		for _, key := range []interface{}{"ydg", int64(3232235522), uint8(7)} {
+			got, want := restored.RemainingVisits(key), r.RemainingVisits(key)
+			if got[0] != want[0] || got[1] != want[1] {
+				t.Fatalf("%+v: remaining visits of %v: got %v want %v", opts, key, got, want)
+			}
+		}
+	}
+	if sizes[SaveOptions{Format: BackupFormatCompact}] >= sizes[SaveOptions{Format: BackupFormatLegacy}] {
+		t.Fatalf("compact snapshot is not smaller than legacy snapshot: %v", sizes)
+	}
+}
+
+func Test_restoreSkipsExpired(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Minute, 10)
+	now := time.Now()
+	s := &snapshot{rules: []*snapshotRule{{keys: []snapshotKey{
+		{key: "expired", records: []int64{now.Add(-time.Second * 2).UnixNano(), now.Add(-time.Second).UnixNano()}},
+		{key: "mixed", records: []int64{now.Add(-time.Second).UnixNano(), now.Add(time.Second * 30).UnixNano()}},
+	}}}}
+	stats, err := r.restore(s, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 1 || stats.Records != 1 || stats.SkippedExpiredRecords != 3 || stats.SkippedEmptyKeys != 1 {
+		t.Fatalf("unexpected load statistics: %+v", stats)
+	}
+	if users := r.GetCurOnlineUsers(); len(users) != 1 || users[0] != "mixed" {
+		t.Fatalf("unexpected online users after restore: %v", users)
+	}
+}
+
+func Test_restoreClockSkew(t *testing.T) {
+	now := time.Now()
+	//存盘时的系统时间比现在快1小时
+	newSnapshot := func() *snapshot {
+		return &snapshot{rules: []*snapshotRule{{keys: []snapshotKey{
+			{key: "ydg", records: []int64{now.Add(time.Second * 30).UnixNano(), now.Add(time.Hour + time.Second*30).UnixNano()}},
+		}}}}
+	}
+	for _, c := range []struct {
+		opts    SaveOptions
+		ok      bool
+		clamped int
+	}{
+		{SaveOptions{}, false, 0},
+		{SaveOptions{ClockSkewTolerance: time.Minute}, false, 0},
+		{SaveOptions{ClockSkewTolerance: time.Hour}, true, 0},
+		{SaveOptions{ClampFutureRecords: true}, true, 1},
+	} {
+		r := NewRule()
+		r.AddRule(time.Minute, 10)
+		r.SetSaveOptions(c.opts)
+		stats, err := r.restore(newSnapshot(), now)
+		if (err == nil) != c.ok {
+			t.Fatalf("%+v: unexpected error: %v", c.opts, err)
+		}
+		if c.ok && (stats.Records != 2 || stats.ClampedRecords != c.clamped) {
+			t.Fatalf("%+v: unexpected load statistics: %+v", c.opts, stats)
+		}
+	}
+}
+
+func Test_saveToLoadFrom(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Minute, 10)
+	r.SetSaveOptions(SaveOptions{Format: BackupFormatCompact, Compression: CompressionGzip})
+	r.AllowVisit("ydg")
+	r.AllowVisit("ydg")
+	var buf bytes.Buffer
+	if err := r.SaveTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if stats := r.LastSaveStatistics(); stats.Keys != 1 || stats.Records != 2 {
+		t.Fatalf("unexpected save statistics: %+v", stats)
+	}
+	restored := NewRule()
+	restored.AddRule(time.Minute, 10)
+	if err := restored.LoadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.RemainingVisit("ydg"); got != 8 {
+		t.Fatalf("unexpected remaining visits after LoadFrom; got %d want %d", got, 8)
+	}
+}
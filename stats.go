@@ -0,0 +1,323 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Stats的排序方式
+const (
+	StatsSortByKey       = iota //按key排序,不同类型的key先按类型名排序,整数按数值排序,其它类型按FormatKey生成的文本排序
+	StatsSortByVisits           //按访问次数从多到少排序
+	StatsSortByRemaining        //按剩余访问次数从少到多排序
+)
+
+//Stats默认每页返回的用户数
+const statsDefaultLimit = 1000
+
+//Stats的查询条件
+type StatsQuery struct {
+	Prefix string        //只返回以Prefix开头的string类型的用户
+	CIDR   netip.Prefix  //只返回在该网段内的IP,包括以int64存储的IP4(见AllowVisitByIP4),netip.Addr以及IP形式的string
+	SortBy int           //排序方式,默认为StatsSortByKey
+	Window time.Duration //StatsSortByVisits及StatsSortByRemaining按计时周期为Window的规则排序,默认为计时周期最长的规则
+	Limit  int           //每页最多返回的用户数,默认为1000
+	Cursor string        //上一页返回的NextCursor,为空时返回第一页
+}
+
+//某用户在各条规则中的访问情况
+type KeyStats struct {
+	Key     interface{} //用户,与AllowVisit时传入的key相同
+	KeyType string      //key的类型,与FormatKey返回的类型名称相同,例如string,int64,codec:1,未注册编解码器的类型为其Go类型名
+	Rules   []RuleStats //按计时周期从小到大排列,与AddRule增加的规则一一对应
+}
+
+//某用户的访问状态,即KeyStats,由Range返回
+type KeyState = KeyStats
+
+//某用户在某条规则中的访问情况
+type RuleStats struct {
+	Window  time.Duration //计时周期
+	Used    int           //计时周期内的访问次数
+	Limit   int           //计时周期内最多允许访问的次数
+	ResetAt time.Time     //所有访问记录均过期,即访问次数恢复为0的时间,没有访问记录时为零值
+}
+
+//Stats返回的一页数据
+type StatsPage struct {
+	Keys       []KeyStats
+	NextCursor string //下一页的Cursor,已是最后一页时为空
+}
+
+var errStatsCursor = errors.New("invalid stats cursor")
+
+//用于排序的用户,按(value,keyType,num,text)从小到大排列,keyType及text由FormatKey生成,可唯一确定一个用户
+type statsEntry struct {
+	value   int
+	keyType string
+	text    string
+	num     uint64 //整数类型的key按数值排序,有符号整数翻转符号位后与无符号整数的顺序一致
+	numeric bool
+	stats   *KeyStats
+}
+
+//生成用于排序的用户
+func newStatsEntry(value int, keyType, text string, stats *KeyStats) statsEntry {
+	e := statsEntry{value: value, keyType: keyType, text: text, stats: stats}
+	switch keyType {
+	case "int", "int8", "int16", "int32", "int64":
+		if v, err := strconv.ParseInt(text, 10, 64); err == nil {
+			e.num, e.numeric = uint64(v)^(1<<63), true
+		}
+	case "uint", "uint8", "uint16", "uint32", "uint64":
+		if v, err := strconv.ParseUint(text, 10, 64); err == nil {
+			e.num, e.numeric = v, true
+		}
+	}
+	return e
+}
+
+//key的类型及文本形式,与FormatKey相同,没有注册编解码器的类型以%T及%#v表示,
+//%#v不调用String方法,指针字段输出其地址,所以不同的key一般不会有相同的文本
+func keyTypeAndText(key interface{}) (keyType, text string) {
+	keyType, text, err := FormatKey(key)
+	if err != nil {
+		return fmt.Sprintf("%T", key), fmt.Sprintf("%#v", key)
+	}
+	return keyType, text
+}
+
+/*
+按查询条件分页返回用户的访问情况,例:
+page, err := r.Stats(ratelimit.StatsQuery{SortBy: ratelimit.StatsSortByVisits, Limit: 100})
+for page.NextCursor != "" {
+	page, err = r.Stats(ratelimit.StatsQuery{SortBy: ratelimit.StatsSortByVisits, Limit: 100, Cursor: page.NextCursor})
+}
+每次调用都遍历所有用户并排序,时间复杂度为O(n log n)。Cursor记录的是上一页最后一个用户的排序位置,
+翻页期间用户的访问次数发生变化时,同一用户可能出现在两页中或者不出现
+*/
+func (r *Rule) Stats(query StatsQuery) (StatsPage, error) {
+	if len(r.rules) == 0 {
+		panic("rule is empty，please add rule by AddRule")
+	}
+	var page StatsPage
+	sortRule := len(r.rules) - 1
+	if query.Window != 0 {
+		sortRule = -1
+		for i, s := range r.rules {
+			if s.defaultExpiration == query.Window {
+				sortRule = i
+			}
+		}
+		if sortRule < 0 {
+			return page, errors.New("there is no rule with window " + query.Window.String())
+		}
+	}
+	if query.Limit <= 0 {
+		query.Limit = statsDefaultLimit
+	}
+	//同一用户在各条规则中只出现一次
+	users := make(map[interface{}]*KeyStats)
+	for i, s := range r.rules {
+		s.rangeKeys(func(key interface{}, q *autoGrowCircleQueueInt64) bool {
+			if !query.match(key) || !q.lockFor(s, key) {
+				return true
+			}
+			used := q.usedSize()
+			var resetAt time.Time
+			if used > 0 {
+				resetAt = time.Unix(0, q.newest())
+			}
+			q.locker.Unlock()
+			ks := users[key]
+			if ks == nil {
+				ks = &KeyStats{Key: key, Rules: make([]RuleStats, len(r.rules))}
+				ks.KeyType, _ = keyTypeAndText(key)
+				for ii, s := range r.rules {
+					ks.Rules[ii] = RuleStats{Window: s.defaultExpiration, Limit: s.numberOfAllowedAccesses}
+				}
+				users[key] = ks
+			}
+			ks.Rules[i].Used = used
+			ks.Rules[i].ResetAt = resetAt
+			return true
+		})
+	}
+	entries := make([]statsEntry, 0, len(users))
+	for key, ks := range users {
+		value := 0
+		switch query.SortBy {
+		case StatsSortByKey:
+		case StatsSortByVisits:
+			value = -ks.Rules[sortRule].Used
+		case StatsSortByRemaining:
+			value = ks.Rules[sortRule].Limit - ks.Rules[sortRule].Used
+		default:
+			return page, errors.New("unknown sort option " + strconv.Itoa(query.SortBy))
+		}
+		keyType, text := keyTypeAndText(key)
+		entries = append(entries, newStatsEntry(value, keyType, text, ks))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].less(&entries[j])
+	})
+	start := 0
+	if query.Cursor != "" {
+		after, err := decodeStatsCursor(query.Cursor)
+		if err != nil {
+			return page, err
+		}
+		start = sort.Search(len(entries), func(i int) bool {
+			return after.less(&entries[i])
+		})
+	}
+	end := min(start+query.Limit, len(entries))
+	for i := start; i < end; i++ {
+		page.Keys = append(page.Keys, *entries[i].stats)
+	}
+	if end < len(entries) {
+		page.NextCursor = entries[end-1].cursor()
+	}
+	return page, nil
+}
+
+func (e *statsEntry) less(other *statsEntry) bool {
+	if e.value != other.value {
+		return e.value < other.value
+	}
+	if e.keyType != other.keyType {
+		return e.keyType < other.keyType
+	}
+	if e.numeric && other.numeric && e.num != other.num {
+		return e.num < other.num
+	}
+	return e.text < other.text
+}
+
+//Cursor中记录的排序位置
+type statsCursor struct {
+	Value   int    `json:"v"`
+	KeyType string `json:"t"`
+	Text    string `json:"k"`
+}
+
+//把排序位置编码为Cursor
+func (e *statsEntry) cursor() string {
+	b, _ := json.Marshal(statsCursor{Value: e.value, KeyType: e.keyType, Text: e.text})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeStatsCursor(cursor string) (*statsEntry, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errStatsCursor
+	}
+	var c statsCursor
+	if err = json.Unmarshal(b, &c); err != nil {
+		return nil, errStatsCursor
+	}
+	e := newStatsEntry(c.Value, c.KeyType, c.Text, nil)
+	return &e, nil
+}
+
+//用户是否符合查询条件
+func (query *StatsQuery) match(key interface{}) bool {
+	if query.Prefix != "" {
+		s, ok := key.(string)
+		if !ok || !strings.HasPrefix(s, query.Prefix) {
+			return false
+		}
+	}
+	if query.CIDR.IsValid() {
+		addr, ok := keyAddr(key)
+		if !ok || !query.CIDR.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+//key所代表的IP,int64按AllowVisitByIP4的方式视为IP4
+func keyAddr(key interface{}) (netip.Addr, bool) {
+	switch k := key.(type) {
+	case netip.Addr:
+		return k.Unmap(), true
+	case int64:
+		if k <= 0 || k > 0xffffffff {
+			return netip.Addr{}, false
+		}
+		return netip.AddrFrom4([4]byte{byte(k >> 24), byte(k >> 16), byte(k >> 8), byte(k)}), true
+	case string:
+		addr, err := netip.ParseAddr(k)
+		return addr.Unmap(), err == nil
+	}
+	return netip.Addr{}, false
+}
+
+/*
+依次遍历所有用户,每个用户只调用一次fn,fn返回false时停止遍历,例:
+r.Range(func(ks ratelimit.KeyState) bool {
+	fmt.Println(ks.Key, ks.Rules[0].Used)
+	return true
+})
+与Stats及GetCurOnlineUsers不同,不需要先把所有用户收集到一起,每次只复制一个分片中的用户,适合用户很多时导出数据等。
+从计时周期最长的规则开始遍历,用户在其所在的计时周期最长的规则中遍历到时调用fn。
+计时周期较短的规则中的访问记录不会晚于较长的规则过期,所以遍历期间有用户过期也不会重复遍历,
+但遍历期间加入的用户可能遍历不到,遍历期间被淘汰或删除后又重新加入的用户可能被遍历两次
+*/
+func (r *Rule) Range(fn func(KeyState) bool) {
+	for i := len(r.rules) - 1; i >= 0; i-- {
+		stop := false
+		r.rules[i].rangeKeys(func(key interface{}, q *autoGrowCircleQueueInt64) bool {
+			//在计时周期更长的规则中已遍历过
+			for _, longer := range r.rules[i+1:] {
+				if longer.exists(key) {
+					return true
+				}
+			}
+			ks, ok := r.statsOf(key)
+			if ok && !fn(ks) {
+				stop = true
+				return false
+			}
+			return true
+		})
+		if stop {
+			return
+		}
+	}
+}
+
+//某用户在各条规则中的访问情况,用户已不在任何规则中时返回false
+func (r *Rule) statsOf(key interface{}) (KeyStats, bool) {
+	ks := KeyStats{Key: key, Rules: make([]RuleStats, len(r.rules))}
+	ks.KeyType, _ = keyTypeAndText(key)
+	found := false
+	for i, s := range r.rules {
+		ks.Rules[i] = RuleStats{Window: s.defaultExpiration, Limit: s.numberOfAllowedAccesses}
+		q := s.lookup(key)
+		if q == nil || !q.lockFor(s, key) {
+			continue
+		}
+		found = true
+		ks.Rules[i].Used = q.usedSize()
+		if ks.Rules[i].Used > 0 {
+			ks.Rules[i].ResetAt = time.Unix(0, q.newest())
+		}
+		q.locker.Unlock()
+	}
+	return ks, found
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_statsPagination(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Minute, 100)
+	r.AddRule(time.Hour, 1000)
+	for i := 0; i < 25; i++ {
+		for ii := 0; ii <= i%5; ii++ {
+			r.AllowVisit("user_" + strconv.Itoa(i))
+		}
+	}
+	r.AllowVisitByIP4("10.0.0.1")
+	seen := make(map[interface{}]bool)
+	query := StatsQuery{SortBy: StatsSortByVisits, Prefix: "user_", Limit: 10}
+	pre := 1 << 30
+	for pages := 0; ; pages++ {
+		page, err := r.Stats(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ks := range page.Keys {
+			if seen[ks.Key] || ks.KeyType != "string" || ks.Rules[1].Used > pre || ks.Rules[1].Limit != 1000 {
+				t.Fatalf("unexpected key stats: %+v", ks)
+			}
+			seen[ks.Key] = true
+			pre = ks.Rules[1].Used
+		}
+		if page.NextCursor == "" {
+			if pages != 2 {
+				t.Fatalf("expected 3 pages,got %d", pages+1)
+			}
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	if len(seen) != 25 {
+		t.Fatalf("expected 25 keys,got %d", len(seen))
+	}
+}
+
+func Test_statsCIDR(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Minute, 100)
+	r.AllowVisitByIP4("192.168.1.10")
+	r.AllowVisit("192.168.1.11")
+	r.AllowVisit(netip.MustParseAddr("192.168.2.1"))
+	r.AllowVisit(int64(7))
+	page, err := r.Stats(StatsQuery{CIDR: netip.MustParsePrefix("192.168.1.0/24")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Keys) != 2 || page.Keys[0].KeyType != "int64" || page.Keys[1].Key != "192.168.1.11" {
+		t.Fatalf("unexpected keys: %+v", page.Keys)
+	}
+	if page.Keys[0].Rules[0].ResetAt.Before(time.Now()) {
+		t.Fatalf("expected reset time in the future,got %v", page.Keys[0].Rules[0].ResetAt)
+	}
+	if _, err = r.Stats(StatsQuery{Cursor: "!"}); err == nil {
+		t.Fatal("expected error for an invalid cursor")
+	}
+}
+
+func Test_statsRange(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Minute, 100)
+	r.AddRule(time.Hour, 1000)
+	for i := 0; i < 100; i++ {
+		r.AllowVisitUint64(uint64(i))
+	}
+	//只在计时周期较长的规则中有访问记录的用户也要遍历到
+	r.rules[0].manualEmptyVisitorRecordsOf(uint64(0))
+	seen := make(map[interface{}]int)
+	r.Range(func(ks KeyState) bool {
+		seen[ks.Key]++
+		if ks.Rules[1].Used != 1 {
+			t.Fatalf("unexpected key stats: %+v", ks)
+		}
+		return true
+	})
+	if len(seen) != 100 || seen[uint64(0)] != 1 {
+		t.Fatalf("expected each key once,got %d keys", len(seen))
+	}
+	for _, n := range seen {
+		if n != 1 {
+			t.Fatal("expected each key once")
+		}
+	}
+	n := 0
+	r.Range(func(ks KeyState) bool {
+		n++
+		return n < 10
+	})
+	if n != 10 {
+		t.Fatalf("expected Range to stop after 10 keys,got %d", n)
+	}
+}
+
+//遍历期间计时周期较短的规则中的用户过期,不会重复遍历
+func Test_statsRangeExpiring(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Millisecond*200, 5)
+	r.AddRule(time.Hour, 100)
+	for i := 0; i < 200; i++ {
+		r.AllowVisitUint64(uint64(i))
+	}
+	seen := make(map[interface{}]int)
+	r.Range(func(ks KeyState) bool {
+		if len(seen) == 0 {
+			time.Sleep(time.Millisecond * 250)
+			r.rules[0].deleteExpiredOnce()
+		}
+		seen[ks.Key]++
+		return true
+	})
+	if r.rules[0].keyNum.Load() != 0 {
+		t.Fatal("expected the keys to expire from the shorter rule during Range")
+	}
+	if len(seen) != 200 {
+		t.Fatalf("expected 200 keys,got %d", len(seen))
+	}
+	for key, n := range seen {
+		if n != 1 {
+			t.Fatalf("expected %v once,got %d", key, n)
+		}
+	}
+}
+
+//String方法返回相同文本的不同用户
+type statsSameTextKey struct{ p *int }
+
+func (statsSameTextKey) String() string { return "same" }
+
+func Test_statsSortByKey(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Minute, 100)
+	for _, i := range []int64{10, 9, -1, 100} {
+		r.AllowVisit(i)
+	}
+	a, b := 1, 1
+	r.AllowVisit(statsSameTextKey{&a})
+	r.AllowVisit(statsSameTextKey{&b})
+	r.AllowVisit(testTenantUser{TenantID: 1, UserID: 2})
+	var keys []interface{}
+	query := StatsQuery{Limit: 1}
+	for {
+		page, err := r.Stats(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ks := range page.Keys {
+			keys = append(keys, ks.Key)
+			if keyType, _, err := FormatKey(ks.Key); err == nil && keyType != ks.KeyType {
+				t.Fatalf("expected key type %q,got %q", keyType, ks.KeyType)
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	//整数按数值排序,String方法相同的用户也都能翻页得到
+	if len(keys) != 7 || keys[1] != int64(-1) || keys[2] != int64(9) || keys[3] != int64(10) || keys[4] != int64(100) {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if keys[0] != (testTenantUser{TenantID: 1, UserID: 2}) {
+		t.Fatalf("expected the codec key first,got %v", keys[0])
+	}
+}
@@ -0,0 +1,399 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+把多个Rule统一保存到同一个目录中,共用一个存盘周期,并由清单文件manifest.json记录每次存盘的所有备份文件,
+加载时只加载清单文件中记录的那一组备份文件,各Rule的数据总是来自同一次存盘,例:
+store := ratelimit.NewStore("/var/lib/app/ratelimit")
+store.Add("paidMember", userVisitRule.paidMember)
+store.Add("freeMember", userVisitRule.freeMember)
+store.Add("anonymousMember", userVisitRule.anonymousMember)
+store.LoadingAndAutoSaveToDisc(time.Second * 10)
+加入Store的Rule由Store统一存盘,不能再单独调用LoadingAndAutoSaveToDisc
+*/
+type Store struct {
+	dir              string
+	rules            []storeRule
+	lock             *os.File      //目录的锁,防止多个进程同时使用同一目录
+	backUpInterval   time.Duration //默认多长时间需要执行一次数据备份操作
+	finished         atomic.Bool   //上一轮次的存盘是否已完成
+	stopAutoSave     chan struct{}
+	stopAutoSaveOnce sync.Once
+	saveOptions      SaveOptions
+	sequence         uint64 //最近一次存盘的序号,每次存盘的备份文件名中均带有序号
+	started          bool
+	closed           atomic.Bool //已调用Close
+	locker           sync.Mutex
+	loadOnce         sync.Once
+}
+
+type storeRule struct {
+	name string
+	r    *Rule
+}
+
+//清单文件,记录最近一次存盘的所有备份文件
+type storeManifest struct {
+	Version  int                 `json:"version"`
+	Sequence uint64              `json:"sequence"`
+	SavedAt  string              `json:"saved_at"`
+	Rules    []storeManifestRule `json:"rules"`
+}
+
+type storeManifestRule struct {
+	Name    string   `json:"name"`
+	File    string   `json:"file"`
+	Windows []string `json:"windows"`
+	Limits  []int    `json:"limits"`
+	Keys    int      `json:"keys"`
+	Records int      `json:"records"`
+}
+
+const storeManifestName = "manifest.json"
+
+//名称会用作备份文件名的一部分,只允许使用字母,数字,下划线及中划线
+var storeNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+//初始化一个Store,dir为备份文件所在目录,不存在时自动创建
+func NewStore(dir string) *Store {
+	if dir == "" {
+		panic("store dir can't be empty")
+	}
+	return &Store{dir: dir}
+}
+
+//把一个Rule加入Store,需在AddRule之后,LoadingAndAutoSaveToDisc之前调用,name在Store中不能重复
+func (st *Store) Add(name string, r *Rule) {
+	if !storeNamePattern.MatchString(name) {
+		panic(`store name "` + name + `" is illegal,only letters,digits,"_" and "-" are allowed`)
+	}
+	if len(r.rules) == 0 {
+		panic("rule is empty，please add rule by AddRule")
+	}
+	r.mustBeWritable()
+	st.locker.Lock()
+	defer st.locker.Unlock()
+	if st.started {
+		panic("cant't use Add after LoadingAndAutoSaveToDisc")
+	}
+	for _, sr := range st.rules {
+		if sr.name == name {
+			panic(`store name "` + name + `" is already used`)
+		}
+	}
+	r.lockerForBackup.Lock()
+	defer r.lockerForBackup.Unlock()
+	if r.needBackup || r.inStore {
+		panic(`rule "` + name + `" is already backed up by LoadingAndAutoSaveToDisc or another Store`)
+	}
+	r.inStore = true
+	st.rules = append(st.rules, storeRule{name: name, r: r})
+	//未设置名称时以在Store中的名称作为监控指标中的名称
+	if r.name == "" {
+		r.name = name
+	}
+}
+
+//设置数据备份选项,对Store中的所有Rule均有效,其中的Directory及Retention无效
+func (st *Store) SetSaveOptions(opts SaveOptions) {
+	st.locker.Lock()
+	defer st.locker.Unlock()
+	st.saveOptions = opts
+}
+
+/*
+加载目录中最近一次存盘的数据,并开启自动保存,默认60秒完成一次存盘
+加载前会先校验所有Rule的备份数据,任一备份数据有误时直接panic,不会只加载其中一部分Rule
+清单文件中有而Store中没有的名称会被忽略,Store中有而清单文件中没有的名称从空数据开始
+*/
+func (st *Store) LoadingAndAutoSaveToDisc(backUpInterval ...time.Duration) {
+	st.loadOnce.Do(func() {
+		st.locker.Lock()
+		defer st.locker.Unlock()
+		if len(st.rules) == 0 {
+			panic("store is empty,please add rule by Add")
+		}
+		st.started = true
+		st.finished.Store(true)
+		st.backUpInterval = time.Second * 60
+		if len(backUpInterval) > 0 {
+			st.backUpInterval = backUpInterval[0]
+		}
+		err := os.MkdirAll(st.dir, 0755)
+		if err != nil {
+			panic(err)
+		}
+		st.lock, err = lockFile(filepath.Join(st.dir, storeManifestName+".lock"))
+		if err != nil {
+			panic(`can't lock the store dir:"` + st.dir + `",` + err.Error())
+		}
+		if err = st.loading(); err != nil {
+			panic(err.Error() + ` please repair or remove the store dir:"` + st.dir + `" and then restart this program.`)
+		}
+		st.stopAutoSave = make(chan struct{})
+		go st.autoSave()
+	})
+}
+
+//加载清单文件中记录的所有备份文件,先全部解析及校验通过后再加载,各Rule的加载耗时均记为整个加载过程的耗时
+func (st *Store) loading() (err error) {
+	start := time.Now()
+	defer func() {
+		for _, sr := range st.rules {
+			sr.r.loadMetric.observe(start, err)
+			var stats BackupStatistics
+			if err == nil {
+				stats = sr.r.lastLoad
+			}
+			sr.r.notifyLoad(stats, err)
+		}
+	}()
+	m, err := st.readManifest()
+	if os.IsNotExist(err) {
+		//初次运行程序时，无清单文件，不认为是错误
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	st.sequence = m.Sequence
+	now := clockNow()
+	snapshots := make([]*snapshot, len(st.rules))
+	for i, sr := range st.rules {
+		for _, mr := range m.Rules {
+			if mr.Name != sr.name {
+				continue
+			}
+			if err = sr.r.verifyManifest(mr); err != nil {
+				return fmt.Errorf("%s: %v", sr.name, err)
+			}
+			if snapshots[i], err = st.readSnapshot(mr.File); err != nil {
+				return fmt.Errorf("%s: %v", sr.name, err)
+			}
+			if err = sr.r.verify(snapshots[i], now, st.saveOptions); err != nil {
+				return fmt.Errorf("%s: %v", sr.name, err)
+			}
+		}
+	}
+	for i, sr := range st.rules {
+		if snapshots[i] == nil {
+			continue
+		}
+		sr.r.lockerForBackup.Lock()
+		sr.r.lastLoad, err = sr.r.apply(snapshots[i], now, st.saveOptions)
+		sr.r.lockerForBackup.Unlock()
+		if err != nil {
+			return fmt.Errorf("%s: %v", sr.name, err)
+		}
+	}
+	return nil
+}
+
+func (st *Store) readManifest() (*storeManifest, error) {
+	b, err := os.ReadFile(filepath.Join(st.dir, storeManifestName))
+	if err != nil {
+		return nil, err
+	}
+	m := new(storeManifest)
+	if err = json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", storeManifestName, err)
+	}
+	if m.Version != 1 {
+		return nil, fmt.Errorf("unsupported %s version:%d", storeManifestName, m.Version)
+	}
+	return m, nil
+}
+
+func (st *Store) readSnapshot(file string) (*snapshot, error) {
+	//清单文件中只应有文件名,防止被修改为其它目录下的文件
+	if file != filepath.Base(file) {
+		return nil, fmt.Errorf("invalid backup file name %q", file)
+	}
+	f, err := os.Open(filepath.Join(st.dir, file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readSnapshot(f)
+}
+
+//原始格式的备份文件中未记录计时周期,以清单文件中记录的规则为准校验
+func (r *Rule) verifyManifest(mr storeManifestRule) error {
+	if len(mr.Windows) != len(r.rules) {
+		return errBackupRulesDifferent
+	}
+	for i, window := range mr.Windows {
+		if expiration, err := time.ParseDuration(window); err != nil || expiration != r.rules[i].defaultExpiration {
+			return errBackupRulesDifferent
+		}
+	}
+	return nil
+}
+
+//定期自动存盘,直到stopAutoSave被关闭
+func (st *Store) autoSave() {
+	ticker := time.NewTicker(st.backUpInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if st.finished.CompareAndSwap(true, false) {
+				st.SaveToDiscOnce()
+				st.finished.Store(true)
+			}
+		case <-st.stopAutoSave:
+			return
+		}
+	}
+}
+
+/*
+把Store中所有Rule的数据保存到硬盘上,每次存盘的备份文件名中均带有递增的序号,
+所有备份文件写入完成后再替换清单文件,替换过程中程序中断时,清单文件仍指向上一次完整的存盘
+*/
+func (st *Store) SaveToDiscOnce() error {
+	st.locker.Lock()
+	defer st.locker.Unlock()
+	if !st.started {
+		panic("If you want't to SaveToDiscOnce,you should use LoadingAndAutoSaveToDisc after Add.")
+	}
+	//Close之后目录的锁已释放,其它进程可能正在使用该目录
+	if st.lock == nil {
+		return errBackupFileReleased
+	}
+	sequence := st.sequence + 1
+	m := storeManifest{Version: 1, Sequence: sequence, SavedAt: time.Now().UTC().Format(time.RFC3339Nano)}
+	stats := make([]BackupStatistics, len(st.rules))
+	for i, sr := range st.rules {
+		mr := storeManifestRule{Name: sr.name, File: sr.name + "." + strconv.FormatUint(sequence, 10) + ".ratelimit"}
+		for _, rule := range sr.r.rules {
+			mr.Windows = append(mr.Windows, rule.defaultExpiration.String())
+			mr.Limits = append(mr.Limits, rule.numberOfAllowedAccesses)
+		}
+		var err error
+		if stats[i], err = st.saveRule(sr.r, mr.File); err != nil {
+			return fmt.Errorf("%s: %v", sr.name, err)
+		}
+		mr.Keys, mr.Records = stats[i].Keys, stats[i].Records
+		m.Rules = append(m.Rules, mr)
+	}
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = st.writeFile(storeManifestName, b); err != nil {
+		return err
+	}
+	st.sequence = sequence
+	for i, sr := range st.rules {
+		sr.r.lockerForBackup.Lock()
+		sr.r.lastSave = stats[i]
+		sr.r.lockerForBackup.Unlock()
+	}
+	return st.removeStale()
+}
+
+//把单个Rule的数据写入备份文件
+func (st *Store) saveRule(r *Rule, file string) (stats BackupStatistics, err error) {
+	//解锁之后才通知观察者
+	defer func(start time.Time) {
+		r.saveMetric.observe(start, err)
+		r.notifySave(stats, err)
+	}(time.Now())
+	r.lockerForBackup.Lock()
+	defer r.lockerForBackup.Unlock()
+	f, err := os.CreateTemp(st.dir, file+"_temp*")
+	if err != nil {
+		return stats, err
+	}
+	defer os.Remove(f.Name())
+	err = writeSnapshot(f, st.saveOptions, len(r.rules), func(i int) *snapshotRule {
+		return r.rules[i].snapshot(i, &stats)
+	})
+	//与Rule.saveTo相同,取复制完所有规则之后的时间
+	stats.Time = clockNow()
+	if err != nil {
+		f.Close()
+		return stats, err
+	}
+	if err = f.Close(); err != nil {
+		return stats, err
+	}
+	return stats, os.Rename(f.Name(), filepath.Join(st.dir, file))
+}
+
+//先写临时文件再重命名,以免留下不完整的文件
+func (st *Store) writeFile(file string, b []byte) error {
+	f, err := os.CreateTemp(st.dir, file+"_temp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(st.dir, file))
+}
+
+//删除不再被清单文件引用的备份文件,包括之前存盘中断时留下的备份文件
+func (st *Store) removeStale() error {
+	current := "." + strconv.FormatUint(st.sequence, 10) + ".ratelimit"
+	for _, sr := range st.rules {
+		files, err := filepath.Glob(filepath.Join(st.dir, sr.name+".*.ratelimit"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			sequence := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), sr.name+"."), ".ratelimit")
+			if _, err = strconv.ParseUint(sequence, 10, 64); err != nil || strings.HasSuffix(file, current) {
+				continue
+			}
+			if err = os.Remove(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//停止自动存盘,做最后一次存盘后释放目录的锁,一般在程序退出前调用,重复调用时直接返回nil
+func (st *Store) Close() error {
+	if st.stopAutoSave == nil || !st.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	st.stopAutoSaveOnce.Do(func() { close(st.stopAutoSave) })
+	for !st.finished.CompareAndSwap(true, false) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	defer st.finished.Store(true)
+	err := st.SaveToDiscOnce()
+	st.locker.Lock()
+	defer st.locker.Unlock()
+	if st.lock != nil {
+		unlockFile(st.lock)
+		st.lock = nil
+	}
+	return err
+}
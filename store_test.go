@@ -0,0 +1,122 @@
+// Copyright 2020 rateLimit Author(https://github.com/yudeguang/ratelimit). All Rights Reserved.
+//
+// This Source Code Form is subject to the terms of the MIT License.
+// If a copy of the MIT was not distributed with this file,
+// You can obtain one at https://github.com/yudeguang/ratelimit.
+
+package ratelimit
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newStoreRules(freeLimit int) (*Rule, *Rule) {
+	paid, free := NewRule(), NewRule()
+	paid.AddRule(time.Minute, 100)
+	free.AddRule(time.Minute, freeLimit)
+	return paid, free
+}
+
+func Test_store(t *testing.T) {
+	dir := t.TempDir()
+	paid, free := newStoreRules(10)
+	st := NewStore(dir)
+	st.SetSaveOptions(SaveOptions{Format: BackupFormatCompact})
+	st.Add("paidMember", paid)
+	st.Add("freeMember", free)
+	st.LoadingAndAutoSaveToDisc(time.Hour)
+	paid.AllowVisit("ydg")
+	free.AllowVisit("ydg")
+	free.AllowVisit("ydg")
+	if err := st.SaveToDiscOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//每次存盘后只保留最近一次存盘的备份文件
+	files, _ := filepath.Glob(filepath.Join(dir, "*.ratelimit"))
+	if len(files) != 2 {
+		t.Fatalf("unexpected backup files: %v", files)
+	}
+
+	paid, free = newStoreRules(10)
+	st = NewStore(dir)
+	st.Add("paidMember", paid)
+	st.Add("freeMember", free)
+	st.LoadingAndAutoSaveToDisc(time.Hour)
+	defer st.Close()
+	if remaining := paid.RemainingVisit("ydg"); remaining != 99 {
+		t.Fatalf("expected 99 remaining visits of paidMember,got %d", remaining)
+	}
+	if remaining := free.RemainingVisit("ydg"); remaining != 8 {
+		t.Fatalf("expected 8 remaining visits of freeMember,got %d", remaining)
+	}
+}
+
+func Test_storeRestoresAllOrNothing(t *testing.T) {
+	dir := t.TempDir()
+	paid, free := newStoreRules(10)
+	st := NewStore(dir)
+	st.Add("paidMember", paid)
+	st.Add("freeMember", free)
+	st.LoadingAndAutoSaveToDisc(time.Hour)
+	paid.AllowVisit("ydg")
+	free.AllowVisit("ydg")
+	free.AllowVisit("ydg")
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//freeMember的规则已修改为只允许访问1次,备份数据无法加载,paidMember也不应被加载
+	paid, free = newStoreRules(1)
+	st = NewStore(dir)
+	st.Add("paidMember", paid)
+	st.Add("freeMember", free)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected loading an inconsistent store to panic")
+			}
+		}()
+		st.LoadingAndAutoSaveToDisc(time.Hour)
+	}()
+	if remaining := paid.RemainingVisit("ydg"); remaining != 100 {
+		t.Fatalf("expected paidMember not to be loaded,got %d remaining visits", remaining)
+	}
+}
+
+func Test_storeCloseTwice(t *testing.T) {
+	dir := t.TempDir()
+	paid, free := newStoreRules(10)
+	st := NewStore(dir)
+	st.Add("paidMember", paid)
+	st.Add("freeMember", free)
+	st.LoadingAndAutoSaveToDisc(time.Hour)
+	paid.AllowVisit("ydg")
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//目录已由其它进程使用,再次调用Close不能再存盘
+	paid2, free2 := newStoreRules(10)
+	other := NewStore(dir)
+	other.Add("paidMember", paid2)
+	other.Add("freeMember", free2)
+	other.LoadingAndAutoSaveToDisc(time.Hour)
+	defer other.Close()
+	paid2.AllowVisit("ydg")
+	if err := other.SaveToDiscOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.SaveToDiscOnce(); err != errBackupFileReleased {
+		t.Fatalf("expected errBackupFileReleased,got %v", err)
+	}
+	if other.sequence != 2 {
+		t.Fatalf("expected the other store to keep its sequence,got %d", other.sequence)
+	}
+}
@@ -6,9 +6,11 @@
 package ratelimit
 
 import (
+	"container/heap"
 	"fmt"
 	"sort"
 	"strconv"
+	"time"
 )
 
 const (
@@ -83,19 +85,18 @@ func (r *Rule) RemainingVisitsByIP4(ip string) []int {
 // 获得当前所有的在线用户,注意所有用int64存储的用户会被默认认为是IP地址，会被自动转换为IP的字符串形式输出以方便查看
 // 如果不是本身就是以int64形式存储，而不是IP4，那么可以用ip4StringToInt64自己再转换回去
 func (r *Rule) GetCurOnlineUsers() []string {
-	//向切片Sli中插入没出现过的元素V，如果切片中有V，则不插入
+	//同一用户在多条规则中出现时只插入一次
+	var users []string
+	seen := make(map[string]struct{})
 	var insertIgnoreString = func(s []string, v string) []string {
-		for _, val := range s {
-			if val == v {
-				return s
-			}
+		if _, exist := seen[v]; exist {
+			return s
 		}
-		s = append(s, v)
-		return s
+		seen[v] = struct{}{}
+		return append(s, v)
 	}
-	var users []string
 	for i := range r.rules {
-		r.rules[i].usedVisitorRecordsIndex.Range(func(k, v interface{}) bool {
+		r.rules[i].rangeKeys(func(k interface{}, q *autoGrowCircleQueueInt64) bool {
 			var user string
 			switch k.(type) {
 			case int64:
@@ -138,3 +139,73 @@ func (r *Rule) GetCurOnlineUsersVisitsDetail(num ...int) (CurOnlineUsersVisitsDe
 	}
 	return
 }
+
+// 某用户在某条规则中的访问情况,由TopKeys返回
+type KeyUsage struct {
+	Key       interface{} //用户,与AllowVisit时传入的key相同
+	Visits    int         //计时周期内的访问次数
+	Remaining int         //剩余访问次数
+}
+
+/*
+返回计时周期为window的规则中访问次数最多的n个用户,按访问次数从多到少排列,也即按剩余访问次数从少到多排列,例:
+TopKeys(10, time.Minute)
+用于查找访问最频繁的用户,遍历所有用户,但只用一个大小为n的小根堆保留访问次数最多的用户,不对所有用户排序
+*/
+func (r *Rule) TopKeys(n int, window time.Duration) []KeyUsage {
+	if n < 1 {
+		panic("n must be>0")
+	}
+	s := r.ruleOfWindow(window)
+	top := make(keyUsageHeap, 0, n)
+	s.rangeKeys(func(key interface{}, q *autoGrowCircleQueueInt64) bool {
+		if !q.lockFor(s, key) {
+			return true
+		}
+		u := KeyUsage{Key: key, Visits: q.usedSize(), Remaining: q.unUsedSize()}
+		q.locker.Unlock()
+		if u.Visits == 0 {
+			return true
+		}
+		if len(top) < n {
+			heap.Push(&top, u)
+		} else if u.Visits > top[0].Visits {
+			top[0] = u
+			heap.Fix(&top, 0)
+		}
+		return true
+	})
+	sort.Slice(top, func(i, j int) bool {
+		return top[i].Visits > top[j].Visits
+	})
+	return top
+}
+
+// 计时周期为window的规则,不存在时panic
+func (r *Rule) ruleOfWindow(window time.Duration) *singleRule {
+	for _, s := range r.rules {
+		if s.defaultExpiration == window {
+			return s
+		}
+	}
+	panic("there is no rule with window " + window.String())
+}
+
+// 按访问次数排列的小根堆
+type keyUsageHeap []KeyUsage
+
+func (h keyUsageHeap) Len() int           { return len(h) }
+func (h keyUsageHeap) Less(i, j int) bool { return h[i].Visits < h[j].Visits }
+func (h keyUsageHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *keyUsageHeap) Push(x interface{}) {
+	*h = append(*h, x.(KeyUsage))
+}
+
+func (h *keyUsageHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	u := old[n-1]
+	*h = old[:n-1]
+	return u
+}
@@ -30,3 +30,26 @@ func Test_userStatistics(t *testing.T) {
 		t.Fatalf("unexpected value obtained; got %q want %q", remainingVisit, "0")
 	}
 }
+
+func Test_topKeys(t *testing.T) {
+	r := NewRule()
+	r.AddRule(time.Minute, 100)
+	r.AddRule(time.Hour, 1000)
+	for i := 0; i < 50; i++ {
+		for ii := 0; ii <= i; ii++ {
+			r.AllowVisitUint64(uint64(i))
+		}
+	}
+	top := r.TopKeys(3, time.Hour)
+	if len(top) != 3 {
+		t.Fatalf("expected 3 keys,got %v", top)
+	}
+	for i, u := range top {
+		if u.Key != uint64(49-i) || u.Visits != 50-i || u.Remaining != 1000-u.Visits {
+			t.Fatalf("unexpected top key %d: %+v", i, u)
+		}
+	}
+	if len(r.TopKeys(100, time.Minute)) != 50 {
+		t.Fatal("expected all keys when n exceeds the number of keys")
+	}
+}